@@ -0,0 +1,59 @@
+package tinyresolver
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTypes are the record types ResolveAllTypes resolves if no types are given
+var DefaultTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "SOA", "TXT", "CAA"}
+
+// ResolveAllTypes resolves the types of a name concurrently, unless concurrency is disabled with SetConcurrency, and returns the records in the answers by type.
+// Types without records or that fail to resolve are left out, an error is only returned if all types failed
+func (r *Resolver) ResolveAllTypes(name string, types []string) (map[string][]dns.RR, error) {
+	if len(types) == 0 {
+		types = DefaultTypes
+	}
+	for _, qtype := range types {
+		if _, ok := dns.StringToType[qtype]; !ok {
+			return nil, fmt.Errorf("unknown record type %s", qtype)
+		}
+	}
+
+	res := make(map[string][]dns.RR)
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var err error
+	failed := 0
+	resolve := func(qtype string) {
+		defer wg.Done()
+		msg, qerr := r.Resolve(name, qtype)
+		m.Lock()
+		defer m.Unlock()
+		if qerr != nil {
+			err = qerr
+			failed++
+			return
+		}
+		if rrs := filterRR(msg.Answer, dns.StringToType[qtype]); len(rrs) > 0 {
+			res[qtype] = rrs
+		}
+	}
+	concurrent := r.concurrent()
+	for _, qtype := range types {
+		wg.Add(1)
+		if !concurrent {
+			resolve(qtype)
+			continue
+		}
+		go resolve(qtype)
+	}
+	wg.Wait()
+
+	if failed == len(types) {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,35 @@
+package tinyresolver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveAllTypes(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+		"www.dns.test. 3600 IN A 10.10.10.11",
+		"www.dns.test. 3600 IN MX 10 mail.dns.test.",
+		"www.dns.test. 3600 IN TXT \"v=spf1 -all\"",
+		"mail.dns.test. 3600 IN A 10.10.10.12",
+	)
+
+	rrs, err := resolver.ResolveAllTypes("www.dns.test", nil)
+	assert.Nil(t, err)
+	types := []string{}
+	for qtype := range rrs {
+		types = append(types, qtype)
+	}
+	assert.ElementsMatch(t, []string{"A", "MX", "TXT"}, types)
+	assert.ElementsMatch(t, []string{"10.10.10.10", "10.10.10.11"}, findA(rrs["A"]))
+	assert.Equal(t, []string{"mail.dns.test."}, findMX(rrs["MX"]))
+
+	rrs, err = resolver.ResolveAllTypes("www.dns.test", []string{"MX", "AAAA"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rrs))
+	assert.Equal(t, 1, len(rrs["MX"]))
+
+	_, err = resolver.ResolveAllTypes("www.dns.test", []string{"BOGUS"})
+	assert.NotNil(t, err)
+}
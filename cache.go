@@ -1,105 +1,516 @@
 package tinyresolver
 
 import (
-	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 type rrDetails struct {
-	rr      dns.RR
+	rr dns.RR
+	// key is the record without its TTL, which is the same for each copy of a record
+	key     string
+	expires time.Time
+	// ttl is the TTL the record was cached with
+	ttl time.Duration
+	// rank is how credible the source of the record is
+	rank int
+	// zone is the zone of the nameserver the record came from, empty if unknown
+	zone string
+}
+
+// The ranks of cached records (RFC 2181 section 5.4.1), records of a higher rank replace those of a lower rank
+const (
+	// rankGlue are records from the authority and additional sections, such as referrals and glue
+	rankGlue = iota
+	// rankAnswer are records from the answer of a non-authoritative response
+	rankAnswer
+	// rankAuthority are records from the authority section of an authoritative response, such as the NS records
+	// a zone publishes at its apex
+	rankAuthority
+	// rankAuth are records from the answer of an authoritative response
+	rankAuth
+)
+
+// negative is a cached NXDOMAIN or NODATA answer
+type negative struct {
+	// soa is the SOA record of the zone that gave the answer
+	soa dns.RR
+	// proofs are the NSEC and NSEC3 records and their signatures that prove the answer
+	proofs  []dns.RR
+	expires time.Time
+	// rcode tells NXDOMAIN apart from NODATA
+	rcode int
+}
+
+// setRank is the highest rank cached for a name and type, and until when records of that rank are cached
+type setRank struct {
+	rank    int
 	expires time.Time
 }
 
 type cache struct {
-	rrs []rrDetails
+	// added and refreshed count the records that were new to the cache, and those that were already cached
+	added     uint64
+	refreshed uint64
+	// sets holds the records by name and type
+	sets map[string][]rrDetails
+	// negatives holds the NXDOMAIN and NODATA answers, by name and type
+	negatives map[string]negative
+	// ranks holds the rank of the records of each name and type
+	ranks map[string]setRank
+	// zones holds the amount of records cached from each zone
+	zones map[string]int
+	// zoneLimit is the max records cached from a single zone, 0 is unlimited
+	zoneLimit int
+	// minTTL and maxTTL bound the TTL of cached records in seconds, a maxTTL of 0 is unbounded.
+	// zeroTTL is the TTL records with a TTL of 0 are cached with, 0 does not cache them
+	minTTL  uint32
+	maxTTL  uint32
+	zeroTTL uint32
+	// hints are the root hints the cache is seeded with, and seeded with again when cleared
+	hints []dns.RR
+	// now returns the current time, time.Now if nil
+	now func() time.Time
 	w   sync.RWMutex
 }
 
 // newCache creates a new cache pool
 func newCache() *cache {
-	c := &cache{}
-	for t := range dns.ParseZone(strings.NewReader(root), "", "") {
-		if t.Error != nil {
+	// the embedded root hints are known to be valid
+	rrs, _ := parseRootHints(strings.NewReader(root))
+	return newCacheWithRoot(rrs)
+}
+
+// newCacheWithRoot returns a cache holding the root hints
+func newCacheWithRoot(hints []dns.RR) *cache {
+	c := &cache{
+		sets:      make(map[string][]rrDetails),
+		negatives: make(map[string]negative),
+		ranks:     make(map[string]setRank),
+		now:       time.Now,
+	}
+	for _, rr := range hints {
+		c.addHint(rr)
+	}
+	return c
+}
+
+// addHint adds a root hint to the cache, which stays in the cache when it is cleared
+func (c *cache) addHint(rr dns.RR) {
+	c.w.Lock()
+	c.hints = append(c.hints, dns.Copy(rr))
+	c.w.Unlock()
+	c.addRR(rr)
+}
+
+// clear removes all records and negative answers from the cache, and seeds it with the root hints again
+func (c *cache) clear() {
+	c.w.Lock()
+	c.sets = make(map[string][]rrDetails)
+	c.negatives = make(map[string]negative)
+	c.ranks = make(map[string]setRank)
+	c.zones = make(map[string]int)
+	hints := c.hints
+	c.w.Unlock()
+	for _, rr := range hints {
+		c.addRR(dns.Copy(rr))
+	}
+}
+
+// flush removes all records and negative answers of a name from the cache
+func (c *cache) flush(name string) {
+	name = toLowerFQDN(name)
+	c.w.Lock()
+	defer c.w.Unlock()
+	for set, records := range c.sets {
+		if setName(set) != name {
 			continue
 		}
-		c.addRR(t.RR)
+		for id := len(records) - 1; id >= 0; id-- {
+			c.remove(set, id)
+		}
 	}
-	return c
+	for set := range c.ranks {
+		if setName(set) == name {
+			delete(c.ranks, set)
+		}
+	}
+	for key := range c.negatives {
+		if setName(key) == name {
+			delete(c.negatives, key)
+		}
+	}
+}
+
+// setName returns the name of a cache key made of a name and type
+func setName(set string) string {
+	return set[:strings.LastIndex(set, "_")]
+}
+
+// setClock sets the function the cache gets the current time from, it must be set before the cache is used
+func (c *cache) setClock(now func() time.Time) {
+	c.now = now
+}
+
+// clock returns the current time of the cache
+func (c *cache) clock() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
 }
 
-// addMsg adds all entries in a message to the cache
+// setZoneLimit sets the max records cached from a single zone, 0 or less is unlimited
+func (c *cache) setZoneLimit(limit int) {
+	c.w.Lock()
+	defer c.w.Unlock()
+	c.zoneLimit = limit
+}
+
+// setMinTTL sets the lowest TTL records are cached with
+func (c *cache) setMinTTL(ttl uint32) {
+	c.w.Lock()
+	defer c.w.Unlock()
+	c.minTTL = ttl
+}
+
+// setMaxTTL sets the highest TTL records are cached with, 0 is unbounded
+func (c *cache) setMaxTTL(ttl uint32) {
+	c.w.Lock()
+	defer c.w.Unlock()
+	c.maxTTL = ttl
+}
+
+// setZeroTTL sets the TTL records with a TTL of 0 are cached with, 0 does not cache them
+func (c *cache) setZeroTTL(ttl uint32) {
+	c.w.Lock()
+	defer c.w.Unlock()
+	c.zeroTTL = ttl
+}
+
+// clampTTL returns the TTL a record is cached with, a TTL of 0 means the record must not be cached unless zeroTTL is set
+func (c *cache) clampTTL(ttl uint32) uint32 {
+	if ttl == 0 {
+		return c.zeroTTL
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// addMsg adds all entries in a message to the cache, ranked by the section they are in
 func (c *cache) addMsg(rmsg *dns.Msg) {
+	c.addZoneMsg(rmsg, "")
+}
+
+// addZoneMsg adds all entries in a message a nameserver of zone sent to the cache, ranked by the section they are in
+func (c *cache) addZoneMsg(rmsg *dns.Msg, zone string) {
 	if rmsg == nil {
 		return
 	}
+	answer, authority := rankAnswer, rankGlue
+	if rmsg.Authoritative {
+		// the zone itself answered, its NS records replace the delegation of the parent
+		answer, authority = rankAuth, rankAuthority
+	}
 	for _, rr := range rmsg.Ns {
-		c.addRR(dns.Copy(rr))
+		c.add(dns.Copy(rr), authority, zone)
 	}
 	for _, rr := range rmsg.Answer {
-		c.addRR(dns.Copy(rr))
+		c.add(dns.Copy(rr), answer, zone)
 	}
 	for _, rr := range rmsg.Extra {
-		c.addRR(dns.Copy(rr))
+		c.add(dns.Copy(rr), rankGlue, zone)
 	}
 }
 
-// addRR adds a single record to the cache
+// addRR adds a single record to the cache, ranked as an answer
 func (c *cache) addRR(rr dns.RR) {
+	c.add(rr, rankAnswer, "")
+}
+
+// add adds a single record from a nameserver of zone to the cache. The record replaces the records of the same name
+// and type of a lower rank, and is not added while records of a higher rank are cached
+func (c *cache) add(rr dns.RR, rank int, zone string) {
+	if isPseudo(rr) {
+		return
+	}
 	c.w.Lock()
 	defer c.w.Unlock()
 	//log.Printf("CACHED ADD REQUEST object: %v", rr)
-	rr.Header().Name = toLowerFQDN(rr.Header().Name)
-	switch rr.(type) {
-	case *dns.NS:
-		rr.(*dns.NS).Ns = toLowerFQDN(rr.(*dns.NS).Ns)
+	normalizeNames(rr)
+	now := c.clock()
+	ttl := time.Duration(c.clampTTL(rr.Header().Ttl)) * time.Second
+	expires := now.Add(ttl)
+	set := rr.Header().Name + "_" + dns.TypeToString[rr.Header().Rrtype]
+	// signatures are ranked with the records they cover, the DS records signed by the parent zone are not replaced
+	// by the DNSKEY records signed by the zone itself
+	rankSet, covered := set, uint16(0)
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		rankSet, covered = set+":"+dns.TypeToString[sig.TypeCovered], sig.TypeCovered
 	}
-	for id, cachedrr := range c.rrs {
-		// get record without TTL
-		newRR := removeSliceString(strings.Split(rr.String(), "\t"), 1)
-		cachedRR := removeSliceString(strings.Split(cachedrr.rr.String(), "\t"), 1)
-		if reflect.DeepEqual(newRR, cachedRR) {
-			// record already exists
-			newExpire := time.Now().Add(time.Duration(rr.Header().Ttl) * time.Second)
-			if newExpire.After(cachedrr.expires) {
-				c.rrs[id].expires = newExpire
-			}
-			//log.Printf("CACHED UPDATE EXISTING objects: %v", rr)
-			return
+	if c.ranks == nil {
+		c.ranks = make(map[string]setRank)
+	}
+	current, ok := c.ranks[rankSet]
+	switch {
+	case !ok || !now.Before(current.expires):
+		c.ranks[rankSet] = setRank{rank: rank, expires: expires}
+	case rank < current.rank:
+		// such as glue, which does not override what the zone itself answered
+		return
+	case rank > current.rank:
+		c.expireSet(set, covered, rank)
+		c.ranks[rankSet] = setRank{rank: rank, expires: expires}
+	case expires.After(current.expires):
+		c.ranks[rankSet] = setRank{rank: rank, expires: expires}
+	}
+
+	key := rrKey(rr)
+	records := c.sets[set]
+	for id := range records {
+		if records[id].key != key {
+			continue
+		}
+		// record already exists
+		atomic.AddUint64(&c.refreshed, 1)
+		if expires.After(records[id].expires) {
+			records[id].expires = expires
+			records[id].ttl = ttl
+		}
+		if rank > records[id].rank {
+			records[id].rank = rank
 		}
+		//log.Printf("CACHED UPDATE EXISTING objects: %v", rr)
+		return
+	}
+	if zone != "" {
+		// a zone sending more records than its share makes room among its own records, not those of other zones
+		if c.zoneLimit > 0 && c.zones[zone] >= c.zoneLimit {
+			c.evictZone(zone, now)
+		}
+		if c.zones == nil {
+			c.zones = make(map[string]int)
+		}
+		c.zones[zone]++
 	}
 	rrDetail := rrDetails{
 		rr:      rr,
-		expires: time.Now().Add(time.Duration(rr.Header().Ttl) * time.Second),
+		key:     key,
+		expires: expires,
+		ttl:     ttl,
+		rank:    rank,
+		zone:    zone,
+	}
+	if c.sets == nil {
+		c.sets = make(map[string][]rrDetails)
 	}
-	c.rrs = append(c.rrs, rrDetail)
+	c.sets[set] = append(c.sets[set], rrDetail)
+	atomic.AddUint64(&c.added, 1)
 	//log.Printf("CACHED NEW objects: %v %v", rrDetail.expires, rrDetail.rr)
 }
 
+// expireSet expires the records of a set with a lower rank than rank, of a set of signatures only those covering
+// the covered type
+func (c *cache) expireSet(set string, covered uint16, rank int) {
+	records := c.sets[set]
+	for id := range records {
+		if records[id].rank < rank && (covered == 0 || covers(records[id].rr, covered)) {
+			records[id].expires = time.Time{}
+		}
+	}
+}
+
+// evictZone removes the expired records of a zone, and while the zone is still at its limit the record of the zone
+// that expires first
+func (c *cache) evictZone(zone string, now time.Time) {
+	for set, records := range c.sets {
+		// going backwards, the records moved in place of a removed one were already checked
+		for id := len(records) - 1; id >= 0; id-- {
+			if records[id].zone == zone && !now.Before(records[id].expires) {
+				c.remove(set, id)
+				records = c.sets[set]
+			}
+		}
+	}
+	for c.zones[zone] >= c.zoneLimit {
+		firstSet, first := "", -1
+		for set, records := range c.sets {
+			for id, rr := range records {
+				if rr.zone == zone && (first == -1 || rr.expires.Before(c.sets[firstSet][first].expires)) {
+					firstSet, first = set, id
+				}
+			}
+		}
+		if first == -1 {
+			return
+		}
+		c.remove(firstSet, first)
+	}
+}
+
+// remove removes the record at position id of a set
+func (c *cache) remove(set string, id int) {
+	records := c.sets[set]
+	removed := records[id]
+	records = append(records[:id], records[id+1:]...)
+	if len(records) == 0 {
+		delete(c.sets, set)
+	} else {
+		c.sets[set] = records
+	}
+	if removed.zone != "" {
+		c.zones[removed.zone]--
+	}
+}
+
+// addNegative caches a NXDOMAIN or NODATA answer for a name and type, by keeping its SOA record for the negative TTL
+func (c *cache) addNegative(qname, qtype string, msg *dns.Msg) {
+	if !IsNoData(msg) && !IsNXDomain(msg) {
+		return
+	}
+	ttl, ok := negativeTTL(msg)
+	if !ok {
+		return
+	}
+	var soa dns.RR
+	var proofs []dns.RR
+	for _, rr := range msg.Ns {
+		switch t := rr.Header().Rrtype; {
+		case t == dns.TypeSOA && soa == nil:
+			soa = dns.Copy(rr)
+		case t == dns.TypeNSEC || t == dns.TypeNSEC3:
+			proofs = append(proofs, dns.Copy(rr))
+		case t == dns.TypeRRSIG && (rr.(*dns.RRSIG).TypeCovered == dns.TypeNSEC || rr.(*dns.RRSIG).TypeCovered == dns.TypeNSEC3):
+			proofs = append(proofs, dns.Copy(rr))
+		}
+	}
+	c.w.Lock()
+	defer c.w.Unlock()
+	if c.negatives == nil {
+		c.negatives = make(map[string]negative)
+	}
+	c.negatives[toLowerFQDN(qname)+"_"+qtype] = negative{
+		soa:     soa,
+		proofs:  proofs,
+		expires: c.clock().Add(time.Duration(c.clampTTL(ttl)) * time.Second),
+		rcode:   msg.Rcode,
+	}
+}
+
+// getNegative returns a cached NXDOMAIN or NODATA answer for a name and type, with the rcode of the answer and the
+// SOA record and proofs in the authority section
+func (c *cache) getNegative(qname, qtype string) (*dns.Msg, bool) {
+	now := c.clock()
+	c.w.RLock()
+	negative, ok := c.negatives[toLowerFQDN(qname)+"_"+qtype]
+	c.w.RUnlock()
+	if !ok || !now.Before(negative.expires) {
+		return nil, false
+	}
+	soa := dns.Copy(negative.soa)
+	soa.Header().Ttl = remainingTTL(negative.expires, now)
+	msg := &dns.Msg{Ns: []dns.RR{soa}}
+	for _, rr := range negative.proofs {
+		proof := dns.Copy(rr)
+		proof.Header().Ttl = soa.Header().Ttl
+		msg.Ns = append(msg.Ns, proof)
+	}
+	msg.Rcode = negative.rcode
+	return msg, true
+}
+
+// ttl returns the TTL the cache reports for a record, and false if the record is not cached
+func (c *cache) ttl(rr dns.RR) (uint32, bool) {
+	if isPseudo(rr) {
+		return 0, false
+	}
+	rr = dns.Copy(rr)
+	normalizeNames(rr)
+	key := rrKey(rr)
+	now := c.clock()
+	c.w.RLock()
+	defer c.w.RUnlock()
+	for _, cached := range c.sets[rr.Header().Name+"_"+dns.TypeToString[rr.Header().Rrtype]] {
+		if cached.key == key && now.Before(cached.expires) {
+			return remainingTTL(cached.expires, now), true
+		}
+	}
+	return 0, false
+}
+
+// remainingTTL returns the TTL of a record expiring at expires, in whole seconds left
+func remainingTTL(expires, now time.Time) uint32 {
+	return uint32(expires.Sub(now) / time.Second)
+}
+
+// normalizeNames makes the names in a record lowercase and fully qualified, so each form of a name finds the same records
+func normalizeNames(rr dns.RR) {
+	rr.Header().Name = toLowerFQDN(rr.Header().Name)
+	switch rr.(type) {
+	case *dns.NS:
+		rr.(*dns.NS).Ns = toLowerFQDN(rr.(*dns.NS).Ns)
+	case *dns.CNAME:
+		rr.(*dns.CNAME).Target = toLowerFQDN(rr.(*dns.CNAME).Target)
+	case *dns.MX:
+		rr.(*dns.MX).Mx = toLowerFQDN(rr.(*dns.MX).Mx)
+	}
+}
+
+// expiring returns true if a cached record of the name and type has less than fraction of its TTL left
+func (c *cache) expiring(qname, qtype string, fraction float64) bool {
+	now := c.clock()
+	c.w.RLock()
+	defer c.w.RUnlock()
+	for _, rr := range c.sets[toLowerFQDN(qname)+"_"+qtype] {
+		if now.Before(rr.expires) && float64(rr.expires.Sub(now)) < fraction*float64(rr.ttl) {
+			return true
+		}
+	}
+	return false
+}
+
 // get retreives a query from the cache
 func (c *cache) get(qname, qtype string) *dns.Msg {
+	return c.lookup(qname, qtype, true, true)
+}
+
+// lookup retreives a query from the cache, adding the addresses of MX, NS, SRV and CNAME targets to the additional section if additional is set.
+// Records of the glue rank are left out unless glue is set
+func (c *cache) lookup(qname, qtype string, additional, glue bool) *dns.Msg {
 	msg := &dns.Msg{}
 
-	now := time.Now()
+	now := c.clock()
 	qname = toLowerFQDN(qname)
 	dtype := dns.StringToType[qtype]
-	c.w.Lock()
-	for _, rr := range c.rrs {
-		if rr.rr.Header().Rrtype == dtype && rr.rr.Header().Name == qname && now.Before(rr.expires) {
+	// the lock is released before the addresses of the targets are looked up, which takes it again
+	c.w.RLock()
+	records := c.sets[qname+"_"+qtype]
+	if dtype != dns.TypeRRSIG {
+		// signatures are returned with the records they cover
+		records = append(records[:len(records):len(records)], c.sets[qname+"_RRSIG"]...)
+	}
+	for _, rr := range records {
+		if (rr.rr.Header().Rrtype == dtype || covers(rr.rr, dtype)) && now.Before(rr.expires) && (glue || rr.rank > rankGlue) {
 
 			////log.Printf("expires: %v + in seconds = %v", rr.expires, rr.expires.Sub(now)/time.Second)
 			res := dns.Copy(rr.rr)
-			res.Header().Ttl = uint32(rr.expires.Sub(now) / time.Second)
+			res.Header().Ttl = remainingTTL(rr.expires, now)
 			//rr.rr.Header().Ttl = uint32(rr.expires.Sub(now) / time.Second)
 			msg.Answer = append(msg.Answer, res)
 		}
 	}
-	c.w.Unlock()
+	c.w.RUnlock()
 	//log.Printf("CACHED search: %v %v result1:%d", qname, qtype, len(msg.Answer))
-	if len(msg.Answer) == 0 {
+	if len(msg.Answer) == 0 || !additional {
 		return msg
 	}
 
@@ -116,6 +527,11 @@ func (c *cache) get(qname, qtype string) *dns.Msg {
 			t := c.get(ns, "A")
 			msg.Extra = append(msg.Extra, t.Answer...)
 		}
+	case "SRV":
+		for _, target := range findSRV(msg.Answer) {
+			msg.Extra = append(msg.Extra, c.get(target, "A").Answer...)
+			msg.Extra = append(msg.Extra, c.get(target, "AAAA").Answer...)
+		}
 	case "CNAME":
 		cnames := findCNAME(msg.Answer)
 		for _, cname := range cnames {
@@ -128,7 +544,92 @@ func (c *cache) get(qname, qtype string) *dns.Msg {
 	return msg
 }
 
-// removeSliceString removes a string from a slice of strings
+// sweep removes the expired records and negative answers from the cache
+func (c *cache) sweep() {
+	now := c.clock()
+	c.w.Lock()
+	defer c.w.Unlock()
+	for set, records := range c.sets {
+		// going backwards, the records moved in place of a removed one were already checked
+		for id := len(records) - 1; id >= 0; id-- {
+			if !now.Before(records[id].expires) {
+				c.remove(set, id)
+				records = c.sets[set]
+			}
+		}
+	}
+	for set, rank := range c.ranks {
+		if !now.Before(rank.expires) {
+			delete(c.ranks, set)
+		}
+	}
+	for key, negative := range c.negatives {
+		if !now.Before(negative.expires) {
+			delete(c.negatives, key)
+		}
+	}
+}
+
+// insertStats returns how many records were new to the cache, and how many were already cached when they were added
+func (c *cache) insertStats() (added, refreshed uint64) {
+	return atomic.LoadUint64(&c.added), atomic.LoadUint64(&c.refreshed)
+}
+
+// size returns the amount of records in the cache, including those that expired
+func (c *cache) size() (n int) {
+	c.w.RLock()
+	defer c.w.RUnlock()
+	for _, records := range c.sets {
+		n += len(records)
+	}
+	return n
+}
+
+// covers returns true if rr is a signature of the records of type dtype
+func covers(rr dns.RR, dtype uint16) bool {
+	sig, ok := rr.(*dns.RRSIG)
+	return ok && sig.TypeCovered == dtype
+}
+
+// isPseudo returns true for pseudo records, they describe the transaction, not the data, and are never cached
+func isPseudo(rr dns.RR) bool {
+	switch rr.(type) {
+	case *dns.OPT, *dns.TSIG, *dns.TKEY:
+		return true
+	}
+	return false
+}
+
+// rrKey returns the key of a record in the cache, which is the record without its TTL
+func rrKey(rr dns.RR) string {
+	fields := strings.Split(rr.String(), "\t")
+	if len(fields) < 2 {
+		// not in the presentation format of a record, such as a pseudo record
+		return rr.String()
+	}
+	return strings.Join(removeSliceString(fields, 1), "\t")
+}
+
+// removeSliceString returns a copy of a slice of strings without the string at position s, the slice is not changed
 func removeSliceString(slice []string, s int) []string {
-	return append(slice[:s], slice[s+1:]...)
+	res := make([]string, 0, len(slice)-1)
+	res = append(res, slice[:s]...)
+	return append(res, slice[s+1:]...)
+}
+
+// negativeTTL returns how long a negative answer may be cached, which per RFC 2308 is the
+// lowest of the TTL of the SOA record in the authority section and its MINIMUM field
+func negativeTTL(msg *dns.Msg) (uint32, bool) {
+	if msg == nil {
+		return 0, false
+	}
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl, true
+			}
+			return soa.Hdr.Ttl, true
+		}
+	}
+	return 0, false
 }
@@ -1,6 +1,7 @@
 package tinyresolver
 
 import (
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -23,3 +24,342 @@ func TestCache(t *testing.T) {
 	res1 = c.get("dns.org", "A")
 	assert.Equal(t, 0, len(res1.Answer))
 }
+
+func TestCacheClock(t *testing.T) {
+	c := newCache()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.setClock(func() time.Time { return now })
+
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeSOA}, Ns: "ns1.dns.org.", Mbox: "hostmaster.dns.org.", Minttl: 30}
+	c.addNegative("dns.org.", "AAAA", &dns.Msg{Ns: []dns.RR{soa}})
+	assert.Equal(t, uint32(60), c.get("dns.org.", "A").Answer[0].Header().Ttl)
+
+	// the TTL goes down as the clock advances
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, uint32(50), c.get("dns.org.", "A").Answer[0].Header().Ttl)
+	negative, ok := c.getNegative("dns.org.", "AAAA")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(20), negative.Ns[0].Header().Ttl)
+
+	// and the records expire once it has passed
+	now = now.Add(20 * time.Second)
+	_, ok = c.getNegative("dns.org.", "AAAA")
+	assert.False(t, ok)
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, 0, len(c.get("dns.org.", "A").Answer))
+}
+
+func TestNegativeTTL(t *testing.T) {
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeSOA}, Ns: "ns1.dns.org.", Mbox: "hostmaster.dns.org.", Minttl: 300}
+	rmsg := &dns.Msg{}
+	rmsg.Ns = append(rmsg.Ns, soa)
+
+	// MINIMUM is lower than the SOA TTL
+	ttl, ok := negativeTTL(rmsg)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), ttl)
+
+	// SOA TTL is lower than MINIMUM
+	soa.Hdr.Ttl = 60
+	ttl, ok = negativeTTL(rmsg)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(60), ttl)
+
+	// no SOA, no negative caching
+	_, ok = negativeTTL(&dns.Msg{})
+	assert.False(t, ok)
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := newCache()
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeSOA}, Ns: "ns1.dns.org.", Mbox: "hostmaster.dns.org.", Minttl: 300}
+	rmsg := &dns.Msg{}
+	rmsg.Ns = append(rmsg.Ns, soa)
+
+	c.addNegative("WWW.dns.org", "AAAA", rmsg)
+	msg, ok := c.getNegative("www.dns.org.", "AAAA")
+	assert.True(t, ok)
+	assert.True(t, IsNoData(msg))
+	assert.True(t, msg.Ns[0].Header().Ttl <= 300)
+
+	// only the type without records is negative
+	_, ok = c.getNegative("www.dns.org.", "A")
+	assert.False(t, ok)
+
+	// a name that does not exist keeps its rcode
+	nxdomain := &dns.Msg{Ns: []dns.RR{soa}}
+	nxdomain.Rcode = dns.RcodeNameError
+	c.addNegative("missing.dns.org.", "A", nxdomain)
+	msg, ok = c.getNegative("missing.dns.org.", "A")
+	assert.True(t, ok)
+	assert.True(t, IsNXDomain(msg))
+	assert.False(t, IsNoData(msg))
+
+	// the NSEC records proving the answer are kept with their signatures
+	nsec, _ := dns.NewRR("proof.dns.org. 3600 IN NSEC www.dns.org. A RRSIG NSEC")
+	sig, _ := dns.NewRR("proof.dns.org. 3600 IN RRSIG NSEC 13 3 3600 20300101000000 20200101000000 1 dns.org. AAAA")
+	proven := &dns.Msg{Ns: []dns.RR{soa, nsec, sig}}
+	c.addNegative("proof.dns.org.", "AAAA", proven)
+	msg, ok = c.getNegative("proof.dns.org.", "AAAA")
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(filterRR(msg.Ns, dns.TypeNSEC)))
+	assert.Equal(t, 1, len(filterRR(msg.Ns, dns.TypeRRSIG)))
+
+	// an answer with records is not negative
+	rmsg.Answer = append(rmsg.Answer, &dns.A{Hdr: dns.RR_Header{Name: "mail.dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	c.addNegative("mail.dns.org.", "A", rmsg)
+	_, ok = c.getNegative("mail.dns.org.", "A")
+	assert.False(t, ok)
+}
+
+func TestCachePseudoRecords(t *testing.T) {
+	c := newCache()
+	rmsg := &dns.Msg{}
+	rr := &dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")}
+	rmsg.Answer = append(rmsg.Answer, rr)
+	rmsg.SetEdns0(4096, false)
+	c.addMsg(rmsg)
+
+	for _, records := range c.sets {
+		for _, cached := range records {
+			assert.NotEqual(t, dns.TypeOPT, cached.rr.Header().Rrtype)
+		}
+	}
+	assert.Equal(t, 0, len(c.get(".", "OPT").Answer))
+	assert.Equal(t, 1, len(c.get("dns.org.", "A").Answer))
+}
+
+func BenchmarkCacheAddRR(b *testing.B) {
+	c := newCache()
+	for i := 0; i < 5000; i++ {
+		c.addRR(&dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d.dns.org.", i), Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.addRR(&dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d.dns.org.", i%10000), Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	c := newCache()
+	for i := 0; i < 10000; i++ {
+		c.addRR(&dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d.dns.org.", i), Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.get(fmt.Sprintf("host%d.dns.org.", i%10000), "A")
+	}
+}
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	c := newCache()
+	for i := 0; i < 10000; i++ {
+		c.addRR(&dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d.dns.org.", i), Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+		c.addRR(&dns.MX{Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d.dns.org.", i), Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeMX}, Preference: 10, Mx: fmt.Sprintf("host%d.dns.org.", i)})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.get(fmt.Sprintf("host%d.dns.org.", i%10000), "MX")
+		}
+	})
+}
+
+func TestCacheRefresh(t *testing.T) {
+	c := newCache()
+	size := c.size()
+	rr := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "DNS.org.", Ttl: ttl, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")}
+	}
+
+	c.addRR(rr(10))
+	assert.Equal(t, size+1, c.size())
+	expires := c.sets["dns.org._A"][0].expires
+
+	// the same record with a longer TTL extends the expiry, without adding an entry
+	c.addRR(rr(100))
+	assert.Equal(t, size+1, c.size())
+	assert.True(t, c.sets["dns.org._A"][0].expires.After(expires.Add(80*time.Second)))
+	expires = c.sets["dns.org._A"][0].expires
+
+	// a shorter TTL does not shorten it
+	c.addRR(rr(5))
+	assert.Equal(t, size+1, c.size())
+	assert.Equal(t, expires, c.sets["dns.org._A"][0].expires)
+
+	// a different record is added
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 10, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.11")})
+	assert.Equal(t, size+2, c.size())
+	assert.Equal(t, 2, len(c.get("dns.org", "A").Answer))
+}
+
+func TestCacheNameNormalization(t *testing.T) {
+	c := newCache()
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "dns.org", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "WWW.dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.11")})
+	c.addRR(&dns.CNAME{Hdr: dns.RR_Header{Name: "alias.dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeCNAME}, Target: "WWW.dns.org"})
+
+	// inserted without trailing dot, queried with and without
+	assert.Equal(t, 1, len(c.get("dns.org.", "A").Answer))
+	assert.Equal(t, 1, len(c.get("DNS.org", "A").Answer))
+
+	// inserted with trailing dot, queried with and without
+	assert.Equal(t, 1, len(c.get("www.dns.org", "A").Answer))
+	assert.Equal(t, 1, len(c.get("www.dns.org.", "A").Answer))
+
+	// the same record in a different form is not added twice
+	size := c.size()
+	c.addRR(&dns.CNAME{Hdr: dns.RR_Header{Name: "ALIAS.dns.org", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeCNAME}, Target: "www.dns.org."})
+	assert.Equal(t, size, c.size())
+	cname := c.get("alias.dns.org", "CNAME")
+	assert.Equal(t, 1, len(cname.Answer))
+	assert.Equal(t, 1, len(cname.Extra))
+}
+
+func TestCacheAuthoritativeOverGlue(t *testing.T) {
+	c := newCache()
+	glue := &dns.Msg{}
+	glue.Ns = append(glue.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeNS}, Ns: "ns1.dns.org."})
+	glue.Extra = append(glue.Extra, &dns.A{Hdr: dns.RR_Header{Name: "ns1.dns.org.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.1")})
+	c.addMsg(glue)
+	assert.Equal(t, []string{"10.10.10.1"}, findA(c.get("ns1.dns.org.", "A").Answer))
+
+	// the zone itself has a different address for its nameserver
+	auth := &dns.Msg{}
+	auth.Authoritative = true
+	auth.Answer = append(auth.Answer, &dns.A{Hdr: dns.RR_Header{Name: "ns1.dns.org.", Ttl: 300, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.2")})
+	c.addMsg(auth)
+	assert.Equal(t, []string{"10.10.10.2"}, findA(c.get("ns1.dns.org.", "A").Answer))
+
+	// later glue does not override it
+	c.addMsg(glue)
+	assert.Equal(t, []string{"10.10.10.2"}, findA(c.get("ns1.dns.org.", "A").Answer))
+	assert.Equal(t, []string{"ns1.dns.org."}, findNS(c.get("dns.org.", "NS").Answer))
+}
+
+func TestCacheSignatureRank(t *testing.T) {
+	c := newCache()
+	// the parent zone signs the DS records, the zone itself its DNSKEY records
+	ds, _ := dns.NewRR("dns.org. 3600 IN RRSIG DS 13 2 3600 20300101000000 20200101000000 1 org. AAAA")
+	c.addMsg(&dns.Msg{Answer: []dns.RR{ds}})
+	key, _ := dns.NewRR("dns.org. 3600 IN RRSIG DNSKEY 13 2 3600 20300101000000 20200101000000 2 dns.org. AAAA")
+	c.addMsg(&dns.Msg{MsgHdr: dns.MsgHdr{Authoritative: true}, Answer: []dns.RR{key}})
+
+	assert.Equal(t, 1, len(c.get("dns.org.", "DS").Answer))
+	assert.Equal(t, 1, len(c.get("dns.org.", "DNSKEY").Answer))
+}
+
+func TestCacheZoneLimit(t *testing.T) {
+	c := newCache()
+	c.setZoneLimit(10)
+	other := &dns.Msg{}
+	for i := 0; i < 5; i++ {
+		other.Answer = append(other.Answer, &dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d.other.org.", i), Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.1")})
+	}
+	c.addZoneMsg(other, "other.org.")
+
+	// a single zone sends far more records than its share, the longest lived ones are kept
+	big := &dns.Msg{}
+	for i := 0; i < 100; i++ {
+		big.Extra = append(big.Extra, &dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("ns%d.big.org.", i), Ttl: uint32(3600 + i), Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.2")})
+	}
+	c.addZoneMsg(big, "big.org.")
+	assert.Equal(t, 10, c.zones["big.org."])
+	assert.Equal(t, 0, len(c.get("ns0.big.org.", "A").Answer))
+	assert.Equal(t, 1, len(c.get("ns99.big.org.", "A").Answer))
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 1, len(c.get(fmt.Sprintf("host%d.other.org.", i), "A").Answer))
+	}
+	assert.Equal(t, 5, c.zones["other.org."])
+
+	// expired records are removed before live ones
+	now := time.Now()
+	c.setClock(func() time.Time { return now.Add(2 * time.Minute) })
+	c.setZoneLimit(5)
+	c.addZoneMsg(&dns.Msg{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "new.other.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.3")}}}, "other.org.")
+	assert.Equal(t, 1, c.zones["other.org."])
+	assert.Equal(t, 10, c.zones["big.org."])
+	assert.Equal(t, 1, len(c.get("ns99.big.org.", "A").Answer))
+}
+
+func TestCacheSweep(t *testing.T) {
+	c := newCache()
+	now := time.Now()
+	c.setClock(func() time.Time { return now })
+	size := c.size()
+	for i := 0; i < 10; i++ {
+		c.addRR(&dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d.dns.org.", i), Ttl: 10, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	}
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "www.dns.org.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.11")})
+	assert.Equal(t, size+11, c.size())
+
+	c.sweep()
+	assert.Equal(t, size+11, c.size())
+
+	// only the expired records are removed
+	now = now.Add(time.Minute)
+	c.sweep()
+	assert.Equal(t, size+1, c.size())
+	assert.Equal(t, 1, len(c.get("www.dns.org.", "A").Answer))
+	assert.Equal(t, 0, len(c.get("host1.dns.org.", "A").Answer))
+}
+
+func TestCacheInsertStats(t *testing.T) {
+	resolver := New()
+	added, refreshed := resolver.CacheInsertStats()
+	rr := &dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")}
+
+	resolver.cache.addRR(dns.Copy(rr))
+	resolver.cache.addRR(dns.Copy(rr))
+	nowAdded, nowRefreshed := resolver.CacheInsertStats()
+	assert.Equal(t, added+1, nowAdded)
+	assert.Equal(t, refreshed+1, nowRefreshed)
+}
+
+func TestCacheTTLBounds(t *testing.T) {
+	resolver := New()
+	c := resolver.cache
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.setClock(func() time.Time { return now })
+	resolver.SetMinTTL(30 * time.Second)
+	resolver.SetMaxTTL(time.Hour)
+
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "low.dns.org.", Ttl: 5, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "high.dns.org.", Ttl: 3 * 86400, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.11")})
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "zero.dns.org.", Ttl: 0, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.12")})
+	assert.Equal(t, uint32(30), c.get("low.dns.org.", "A").Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(3600), c.get("high.dns.org.", "A").Answer[0].Header().Ttl)
+	// a TTL of 0 is not raised to the minimum, the record is not cached
+	assert.Equal(t, 0, len(c.get("zero.dns.org.", "A").Answer))
+
+	// the TTL goes down from the bound
+	now = now.Add(20 * time.Second)
+	assert.Equal(t, uint32(10), c.get("low.dns.org.", "A").Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(3580), c.get("high.dns.org.", "A").Answer[0].Header().Ttl)
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, 0, len(c.get("low.dns.org.", "A").Answer))
+
+	// records with a TTL of 0 can be cached briefly
+	resolver.SetZeroTTL(2 * time.Second)
+	c.addRR(&dns.A{Hdr: dns.RR_Header{Name: "zero.dns.org.", Ttl: 0, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.12")})
+	assert.Equal(t, uint32(2), c.get("zero.dns.org.", "A").Answer[0].Header().Ttl)
+}
+
+func TestRemoveSliceString(t *testing.T) {
+	slice := []string{"dns.org.", "60", "IN", "A", "10.10.10.10"}
+	assert.Equal(t, []string{"dns.org.", "IN", "A", "10.10.10.10"}, removeSliceString(slice, 1))
+	assert.Equal(t, []string{"dns.org.", "60", "IN", "A"}, removeSliceString(slice, 4))
+	// the slice passed in is not changed
+	assert.Equal(t, []string{"dns.org.", "60", "IN", "A", "10.10.10.10"}, slice)
+}
+
+func TestCachePseudoRecordTTL(t *testing.T) {
+	c := newCache()
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(1232)
+	_, ok := c.ttl(opt)
+	assert.False(t, ok)
+	assert.Equal(t, opt.String(), rrKey(opt))
+}
@@ -0,0 +1,55 @@
+package tinyresolver
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ServerVersion asks a nameserver for its version (version.bind), the server is an IP with an optional port.
+// The query is sent over TLS if set with SetTLS. The version is empty if the server refuses to tell
+func (r *Resolver) ServerVersion(server string) (string, error) {
+	return r.chaosTXT(server, "version.bind.")
+}
+
+// ServerHostname asks a nameserver for its hostname (hostname.bind), the server is an IP with an optional port.
+// The query is sent over TLS if set with SetTLS. The hostname is empty if the server refuses to tell
+func (r *Resolver) ServerHostname(server string) (string, error) {
+	return r.chaosTXT(server, "hostname.bind.")
+}
+
+// chaosTXT sends a CHAOS class TXT query for name directly to the server, and returns the raw text of the answer
+func (r *Resolver) chaosTXT(server, name string) (string, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host, server = server, net.JoinHostPort(server, r.upstreamPort())
+	}
+	qmsg := &dns.Msg{}
+	qmsg.SetQuestion(name, dns.TypeTXT)
+	qmsg.Question[0].Qclass = dns.ClassCHAOS
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.queryTimeout())
+	defer cancel()
+	// the port of the server is that of DNS over TLS when it is set, so the query has to be sent over TLS as well
+	client := r.tlsClient(host)
+	if client == nil {
+		client = r.client()
+	}
+	rmsg, _, err := client.ExchangeContext(ctx, qmsg, server)
+	if err != nil {
+		return "", err
+	}
+	if rmsg.Rcode == dns.RcodeRefused {
+		return "", nil
+	}
+	if err := validateResponse(qmsg, rmsg); err != nil {
+		return "", err
+	}
+	for _, rr := range rmsg.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			return joinTXT(txt.Txt), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,40 @@
+package tinyresolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerVersion(t *testing.T) {
+	resolver, server := newMockResolver(t)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		if req.Question[0].Qclass != dns.ClassCHAOS || req.Question[0].Name == "hostname.bind." {
+			resp.Rcode = dns.RcodeRefused
+			w.WriteMsg(resp)
+			return true
+		}
+		rr, _ := dns.NewRR("version.bind. 0 CH TXT \"9.18.\" \"24 \\\"dev\\\"\"")
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+		return true
+	})
+
+	// the text is returned as is, without the escapes of the presentation format
+	version, err := resolver.ServerVersion(net.JoinHostPort("127.0.0.11", resolver.port))
+	assert.Nil(t, err)
+	assert.Equal(t, "9.18.24 \"dev\"", version)
+
+	// the port of the resolver is used if none is given
+	version, err = resolver.ServerVersion("127.0.0.11")
+	assert.Nil(t, err)
+	assert.Equal(t, "9.18.24 \"dev\"", version)
+
+	hostname, err := resolver.ServerHostname("127.0.0.11")
+	assert.Nil(t, err)
+	assert.Equal(t, "", hostname)
+}
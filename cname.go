@@ -0,0 +1,54 @@
+package tinyresolver
+
+import "github.com/miekg/dns"
+
+// CanonicalName returns the canonical name of a name, which is the final target after following all CNAMEs. The
+// target does not need an address. If the target fails to resolve, the last name reached is returned together with
+// ErrIncompleteCNAME
+func (r *Resolver) CanonicalName(name string) (string, error) {
+	msg, err := r.Resolve(name, "A")
+	if msg == nil {
+		return "", err
+	}
+	return cnameTarget(msg.Answer, name), err
+}
+
+// CNAMEChain returns the targets of the CNAMEs followed from a name in order, the last being its canonical name.
+// The chain is empty if the name is not an alias. If the last target fails to resolve, the chain up to it is returned
+// together with ErrIncompleteCNAME
+func (r *Resolver) CNAMEChain(name string) ([]string, error) {
+	msg, err := r.Resolve(name, "A")
+	if msg == nil {
+		return nil, err
+	}
+	return cnameChain(msg.Answer, name), err
+}
+
+// cnameTarget follows the CNAME records starting at name, and returns the name at the end of the chain
+func cnameTarget(rrs []dns.RR, name string) string {
+	if chain := cnameChain(rrs, name); len(chain) > 0 {
+		return chain[len(chain)-1]
+	}
+	return toLowerFQDN(name)
+}
+
+// cnameChain follows the CNAME records starting at name, and returns the targets in order
+func cnameChain(rrs []dns.RR, name string) (chain []string) {
+	name = toLowerFQDN(name)
+	// a chain can never be longer than the records given, this also stops on a CNAME loop
+	for i := 0; i < len(rrs); i++ {
+		next := ""
+		for _, rr := range rrs {
+			if cname, ok := rr.(*dns.CNAME); ok && toLowerFQDN(cname.Hdr.Name) == name {
+				next = toLowerFQDN(cname.Target)
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+		chain = append(chain, name)
+	}
+	return chain
+}
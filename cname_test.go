@@ -0,0 +1,144 @@
+package tinyresolver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalName(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN CNAME web.dns.test.",
+		"web.dns.test. 3600 IN CNAME host.dns.test.",
+		"host.dns.test. 3600 IN A 10.10.10.10",
+		"v6.dns.test. 3600 IN CNAME v6host.dns.test.",
+		"v6host.dns.test. 3600 IN AAAA ::1",
+		"broken.dns.test. 3600 IN CNAME failing.dns.test.",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "failing.dns.test." {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+		return true
+	})
+
+	name, err := resolver.CanonicalName("www.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, "host.dns.test.", name)
+
+	// a name that is not an alias is its own canonical name
+	name, err = resolver.CanonicalName("host.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, "host.dns.test.", name)
+
+	// the canonical name does not need an IPv4 address
+	name, err = resolver.CanonicalName("v6.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, "v6host.dns.test.", name)
+
+	// a target that fails to resolve is the last name reached
+	name, err = resolver.CanonicalName("broken.dns.test")
+	assert.Equal(t, ErrIncompleteCNAME, err)
+	assert.Equal(t, "failing.dns.test.", name)
+}
+
+func TestCNAMEChain(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN CNAME web.dns.test.",
+		"web.dns.test. 3600 IN CNAME cdn.dns.test.",
+		"cdn.dns.test. 3600 IN CNAME host.dns.test.",
+		"host.dns.test. 3600 IN A 10.10.10.10",
+		"v6.dns.test. 3600 IN CNAME cdn6.dns.test.",
+		"cdn6.dns.test. 3600 IN CNAME v6host.dns.test.",
+		"v6host.dns.test. 3600 IN AAAA ::1",
+		"broken.dns.test. 3600 IN CNAME relay.dns.test.",
+		"relay.dns.test. 3600 IN CNAME failing.dns.test.",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "failing.dns.test." {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+		return true
+	})
+
+	chain, err := resolver.CNAMEChain("www.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"web.dns.test.", "cdn.dns.test.", "host.dns.test."}, chain)
+
+	// a name that is not an alias has no chain
+	chain, err = resolver.CNAMEChain("host.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(chain))
+
+	// the chain can end at a target without an IPv4 address
+	chain, err = resolver.CNAMEChain("v6.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cdn6.dns.test.", "v6host.dns.test."}, chain)
+
+	// a target that fails to resolve ends the chain
+	chain, err = resolver.CNAMEChain("broken.dns.test")
+	assert.Equal(t, ErrIncompleteCNAME, err)
+	assert.Equal(t, []string{"relay.dns.test.", "failing.dns.test."}, chain)
+}
+
+func TestCNAMEOffPath(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"web.dns.test. 3600 IN CNAME host.dns.test.",
+		"host.dns.test. 3600 IN A 10.10.10.10",
+		"evil.dns.test. 3600 IN A 10.66.66.66",
+	)
+	// the answer for www holds a stray cname, unrelated to the queried name
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "www.dns.test." {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Authoritative = true
+		for _, record := range []string{
+			"www.dns.test. 3600 IN CNAME web.dns.test.",
+			"stray.dns.test. 3600 IN CNAME evil.dns.test.",
+		} {
+			rr, _ := dns.NewRR(record)
+			resp.Answer = append(resp.Answer, rr)
+		}
+		w.WriteMsg(resp)
+		return true
+	})
+
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 0, server.received("evil.dns.test.", "A"))
+	assert.True(t, server.received("web.dns.test.", "A") > 0)
+}
+
+func TestLongCNAMEChain(t *testing.T) {
+	records := []string{}
+	for i := 1; i < MaxDepth; i++ {
+		records = append(records, fmt.Sprintf("c%d.test. 3600 IN CNAME c%d.test.", i, i+1))
+	}
+	records = append(records, fmt.Sprintf("c%d.test. 3600 IN A 10.10.10.10", MaxDepth))
+	for i := 1; i <= 2*MaxDepth; i++ {
+		records = append(records, fmt.Sprintf("long%d.test. 3600 IN CNAME long%d.test.", i, i+1))
+	}
+	resolver, _ := newMockResolver(t, records...)
+
+	// every hop is a separate query, the chain is shorter than the cname limit, so it must resolve
+	rr, err := resolver.Resolve("c1.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, MaxDepth-1, len(findCNAME(rr.Answer)))
+
+	// a chain longer than the cname limit is not followed to the end
+	_, err = resolver.Resolve("long1.test", "A")
+	assert.Equal(t, ErrIncompleteCNAME, err)
+}
@@ -0,0 +1,149 @@
+package tinyresolver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// DelegationReport compares the nameservers of a zone as delegated by the parent zone, with the nameservers the zone publishes itself
+type DelegationReport struct {
+	Zone string
+	// Parent are the nameservers in the delegation at the parent zone
+	Parent []string
+	// Child are the nameservers the zone publishes at its apex
+	Child []string
+	// MissingAtChild are the nameservers only found in the delegation of the parent zone
+	MissingAtChild []string
+	// MissingAtParent are the nameservers only published by the zone itself
+	MissingAtParent []string
+}
+
+// Consistent returns true if the parent and the child zone publish the same nameservers
+func (d *DelegationReport) Consistent() bool {
+	return len(d.MissingAtChild) == 0 && len(d.MissingAtParent) == 0
+}
+
+// CheckDelegation queries the parent zone for the delegation of a zone, and the zone itself for its nameservers, and reports the differences
+func (r *Resolver) CheckDelegation(zone string) (*DelegationReport, error) {
+	zone = toLowerFQDN(zone)
+	pname, ok := parent(zone)
+	if !ok {
+		return nil, ErrMaxParent
+	}
+	pmsg, err := r.Resolve(pname, "NS")
+	if err != nil {
+		return nil, err
+	}
+	pns := findNS(pmsg.Answer)
+	if len(pns) == 0 {
+		return nil, ErrNoNS
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.queryTimeout())
+	defer cancel()
+
+	report := &DelegationReport{Zone: zone}
+	// the parent refers to the zone in the authority section, unless it is authoritative for both
+	dmsg, err := r.queryAny(ctx, pns, zone, "NS")
+	if err != nil {
+		return nil, err
+	}
+	report.Parent = nsNames(dmsg.Ns, zone)
+	if len(report.Parent) == 0 {
+		report.Parent = nsNames(dmsg.Answer, zone)
+	}
+	if len(report.Parent) == 0 {
+		return nil, fmt.Errorf("no delegation for %s found at the parent: %w", zone, ErrNoNS)
+	}
+
+	cmsg, err := r.queryAny(ctx, report.Parent, zone, "NS")
+	if err != nil {
+		return nil, err
+	}
+	report.Child = nsNames(cmsg.Answer, zone)
+
+	report.MissingAtChild = difference(report.Parent, report.Child)
+	report.MissingAtParent = difference(report.Child, report.Parent)
+	return report, nil
+}
+
+// ZoneSerials queries each nameserver of a zone for the SOA record, and returns the serial per nameserver.
+// Nameservers that fail to answer are left out, an error is only returned if none answered
+func (r *Resolver) ZoneSerials(zone string) (map[string]uint32, error) {
+	zone = toLowerFQDN(zone)
+	msg, err := r.Resolve(zone, "NS")
+	if err != nil {
+		return nil, err
+	}
+	ns := uniqueNames(findNS(filterRR(msg.Answer, dns.TypeNS)))
+	if len(ns) == 0 {
+		return nil, ErrNoNS
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.queryTimeout())
+	defer cancel()
+
+	serials := make(map[string]uint32)
+	for _, server := range ns {
+		smsg, serr := r.queryAny(ctx, []string{server}, zone, "SOA")
+		if serr != nil {
+			err = serr
+			continue
+		}
+		for _, rr := range smsg.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && toLowerFQDN(soa.Hdr.Name) == zone {
+				serials[toLowerFQDN(server)] = soa.Serial
+			}
+		}
+	}
+	if len(serials) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no SOA record found for %s", zone)
+		}
+		return nil, err
+	}
+	return serials, nil
+}
+
+// queryAny queries the nameservers one by one, bypassing the cache, and returns the first answer received
+func (r *Resolver) queryAny(ctx context.Context, ns []string, qname, qtype string) (msg *dns.Msg, err error) {
+	qs := newQueryState(0)
+	for _, server := range ns {
+		msg, err = r.querySingle(ctx, server, qname, qtype, qs, 0)
+		if err == nil {
+			return msg, nil
+		}
+	}
+	return nil, err
+}
+
+// nsNames returns the sorted nameserver names of the NS records for zone
+func nsNames(rrs []dns.RR, zone string) (res []string) {
+	for _, rr := range rrs {
+		if ns, ok := rr.(*dns.NS); ok && toLowerFQDN(ns.Hdr.Name) == zone {
+			res = append(res, toLowerFQDN(ns.Ns))
+		}
+	}
+	sort.Strings(res)
+	return
+}
+
+// difference returns the strings in a that are not in b
+func difference(a, b []string) (res []string) {
+	for _, s := range a {
+		found := false
+		for _, t := range b {
+			if s == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, s)
+		}
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package tinyresolver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDelegation(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"dns.test. 3600 IN NS ns2.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+		"ns2.dns.test. 3600 IN A 127.0.0.13",
+	)
+	// the zone itself publishes a different set of nameservers than its parent
+	mn.addServer("127.0.0.12", "dns.test.",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"dns.test. 3600 IN NS ns3.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+		"ns3.dns.test. 3600 IN A 127.0.0.14",
+	)
+	resolver := mn.resolver("127.0.0.10")
+
+	report, err := resolver.CheckDelegation("dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, "dns.test.", report.Zone)
+	assert.Equal(t, []string{"ns1.dns.test.", "ns2.dns.test."}, report.Parent)
+	assert.Equal(t, []string{"ns1.dns.test.", "ns3.dns.test."}, report.Child)
+	assert.Equal(t, []string{"ns2.dns.test."}, report.MissingAtChild)
+	assert.Equal(t, []string{"ns3.dns.test."}, report.MissingAtParent)
+	assert.False(t, report.Consistent())
+}
+
+func TestZoneSerials(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	delegation := []string{
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"dns.test. 3600 IN NS ns2.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+		"ns2.dns.test. 3600 IN A 127.0.0.13",
+	}
+	mn.addServer("127.0.0.11", "test.", append([]string{
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	}, delegation...)...)
+	// the secondary is behind on the primary
+	mn.addServer("127.0.0.12", "dns.test.", append([]string{"dns.test. 3600 IN SOA ns1.dns.test. hostmaster.dns.test. 2020050102 3600 600 86400 300"}, delegation...)...)
+	mn.addServer("127.0.0.13", "dns.test.", append([]string{"dns.test. 3600 IN SOA ns1.dns.test. hostmaster.dns.test. 2020050101 3600 600 86400 300"}, delegation...)...)
+	resolver := mn.resolver("127.0.0.10")
+
+	serials, err := resolver.ZoneSerials("dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]uint32{
+		"ns1.dns.test.": 2020050102,
+		"ns2.dns.test.": 2020050101,
+	}, serials)
+}
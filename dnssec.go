@@ -0,0 +1,74 @@
+package tinyresolver
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SignatureExpiry resolves a record including its signatures, and returns the expiration of the signatures by the type they cover.
+// If a type is signed more than once, the earliest expiration is returned
+func (r *Resolver) SignatureExpiry(name, qtype string) (map[string]time.Time, error) {
+	msg, err := r.ResolveWithOptions(name, qtype, ResolveOptions{DNSSEC: true})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	res := make(map[string]time.Time)
+	for _, rr := range msg.Answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		covered := dns.TypeToString[sig.TypeCovered]
+		expires := signatureTime(sig.Expiration, now)
+		if current, ok := res[covered]; !ok || expires.Before(current) {
+			res[covered] = expires
+		}
+	}
+	return res, nil
+}
+
+// IsDNSSECSigned returns true if a zone is signed, which is when the parent zone has a DS record for it and the zone
+// has a DNSKEY record at its apex
+func (r *Resolver) IsDNSSECSigned(zone string) (bool, error) {
+	zone = toLowerFQDN(zone)
+	pname, ok := parent(zone)
+	if !ok {
+		return false, ErrMaxParent
+	}
+	pmsg, err := r.Resolve(pname, "NS")
+	if err != nil {
+		return false, err
+	}
+	pns := findNS(pmsg.Answer)
+	if len(pns) == 0 {
+		return false, ErrNoNS
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.queryTimeout())
+	defer cancel()
+
+	// the DS record is at the parent side of the delegation, the zone itself does not have it
+	dmsg, err := r.queryAny(ctx, pns, zone, "DS")
+	if err != nil {
+		return false, err
+	}
+	if !hasRR(dmsg.Answer, zone, dns.TypeDS) {
+		return false, nil
+	}
+
+	kmsg, err := r.Resolve(zone, "DNSKEY")
+	if err != nil {
+		return false, err
+	}
+	return hasRR(kmsg.Answer, zone, dns.TypeDNSKEY), nil
+}
+
+// signatureTime converts a signature timestamp to a time, timestamps use serial number arithmetic (RFC 4034)
+// so they are interpreted as the closest time to now
+func signatureTime(ts uint32, now time.Time) time.Time {
+	return time.Unix(now.Unix()+int64(int32(ts-uint32(now.Unix()))), 0).UTC()
+}
@@ -0,0 +1,92 @@
+package tinyresolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureExpiry(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+		"www.dns.test. 3600 IN RRSIG A 8 3 3600 20261101000000 20261001000000 12345 test. c2lnbmF0dXJl",
+		"www.dns.test. 3600 IN RRSIG A 13 3 3600 20261115000000 20261001000000 54321 test. c2lnbmF0dXJl",
+		"www.dns.test. 3600 IN TXT \"text\"",
+		"www.dns.test. 3600 IN RRSIG TXT 8 3 3600 20261201120000 20261001000000 12345 test. c2lnbmF0dXJl",
+	)
+
+	// the earliest signature is returned
+	expiry, err := resolver.SignatureExpiry("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]time.Time{"A": time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)}, expiry)
+
+	// a cached answer still has its signatures
+	expiry, err = resolver.SignatureExpiry("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), expiry["A"])
+
+	expiry, err = resolver.SignatureExpiry("www.dns.test", "TXT")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]time.Time{"TXT": time.Date(2026, 12, 1, 12, 0, 0, 0, time.UTC)}, expiry)
+
+	// without the DO bit no signatures are returned
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rr.Answer))
+}
+
+func TestSignatureTime(t *testing.T) {
+	now := time.Date(2106, 1, 1, 0, 0, 0, 0, time.UTC)
+	// the timestamp wraps around in 2106
+	assert.Equal(t, time.Date(2106, 3, 1, 0, 0, 0, 0, time.UTC), signatureTime(uint32(time.Date(2106, 3, 1, 0, 0, 0, 0, time.UTC).Unix()), now))
+	assert.Equal(t, time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), signatureTime(uint32(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC).Unix()), time.Now()))
+}
+
+func TestIsDNSSECSigned(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	parent := mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+		"dns.test. 3600 IN DS 12345 13 2 2BB183AF5F22588179A53B0A98631FAD1A292118A1B1F20C4C22B3F0F9E6A2C7",
+		"plain.test. 3600 IN NS ns1.plain.test.",
+		"ns1.plain.test. 3600 IN A 127.0.0.13",
+	)
+	// the parent answers DS queries itself, instead of referring to the zone
+	parent.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Qtype != dns.TypeDS {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Authoritative = true
+		resp.Answer = parent.find(req.Question[0].Name, dns.TypeDS)
+		w.WriteMsg(resp)
+		return true
+	})
+	mn.addServer("127.0.0.12", "dns.test.",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+		"dns.test. 3600 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==",
+	)
+	mn.addServer("127.0.0.13", "plain.test.",
+		"plain.test. 3600 IN NS ns1.plain.test.",
+		"ns1.plain.test. 3600 IN A 127.0.0.13",
+	)
+	resolver := mn.resolver("127.0.0.10")
+
+	signed, err := resolver.IsDNSSECSigned("dns.test")
+	assert.Nil(t, err)
+	assert.True(t, signed)
+
+	signed, err = resolver.IsDNSSECSigned("plain.test")
+	assert.Nil(t, err)
+	assert.False(t, signed)
+}
@@ -0,0 +1,38 @@
+package tinyresolver
+
+import "net"
+
+// EnrichedIP is a resolved address together with the metadata returned by the IP enricher
+type EnrichedIP struct {
+	IP   net.IP
+	Meta map[string]string
+}
+
+// SetIPEnricher sets the callback ResolveEnriched uses to add metadata (such as ASN or geo location) to a resolved address
+func (r *Resolver) SetIPEnricher(enricher func(net.IP) map[string]string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.enricher = enricher
+}
+
+// ResolveEnriched resolves a record by name and type, and returns the addresses in the answer with their metadata
+func (r *Resolver) ResolveEnriched(qname, qtype string) ([]EnrichedIP, error) {
+	msg, err := r.Resolve(qname, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	r.m.RLock()
+	enricher := r.enricher
+	r.m.RUnlock()
+
+	res := []EnrichedIP{}
+	for _, ip := range findIP(msg.Answer) {
+		enriched := EnrichedIP{IP: ip}
+		if enricher != nil {
+			enriched.Meta = enricher(ip)
+		}
+		res = append(res, enriched)
+	}
+	return res, nil
+}
@@ -0,0 +1,31 @@
+package tinyresolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveEnriched(t *testing.T) {
+	resolver := New()
+	for _, ip := range []string{"10.10.10.10", "10.10.10.11"} {
+		resolver.cache.addRR(&dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP(ip)})
+	}
+
+	seen := []string{}
+	resolver.SetIPEnricher(func(ip net.IP) map[string]string {
+		seen = append(seen, ip.String())
+		return map[string]string{"asn": "AS64500", "ip": ip.String()}
+	})
+
+	res, err := resolver.ResolveEnriched("dns.org", "A")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"10.10.10.10", "10.10.10.11"}, seen)
+	assert.Equal(t, 2, len(res))
+	for _, enriched := range res {
+		assert.Equal(t, "AS64500", enriched.Meta["asn"])
+		assert.Equal(t, enriched.IP.String(), enriched.Meta["ip"])
+	}
+}
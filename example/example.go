@@ -3,18 +3,18 @@ package main
 import (
 	"log"
 
-	"github.com/miekg/dns"
 	"github.com/rdoorn/tinyresolver"
 )
 
 func main() {
 
 	resolver := tinyresolver.New()
-	rr, err := resolver.Resolve("ghostbox.org", "A")
+	ips, err := resolver.LookupIP("ghostbox.org")
 	if err != nil {
 		panic(err)
 	}
 
-	answer := rr.Extra[0]
-	log.Printf("IP: %s", answer.(*dns.A).A)
+	for _, ip := range ips {
+		log.Printf("IP: %s", ip)
+	}
 }
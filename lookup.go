@@ -0,0 +1,334 @@
+package tinyresolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NotFoundError is returned by the lookups when a name has no records of the type looked up
+type NotFoundError struct {
+	Name string
+	// NXDomain is true if the name does not exist at all
+	NXDomain bool
+}
+
+// Error returns why nothing was found
+func (e *NotFoundError) Error() string {
+	if e.NXDomain {
+		return fmt.Sprintf("%s does not exist", e.Name)
+	}
+	return fmt.Sprintf("no records found for %s", e.Name)
+}
+
+// resolve resolves a record for the lookups, a name that does not exist is no error but returns a message with
+// the NXDOMAIN rcode, which the lookups turn into a *NotFoundError
+func (r *Resolver) resolve(name, qtype string) (*dns.Msg, error) {
+	msg, err := r.Resolve(name, qtype)
+	if errors.Is(err, ErrNXDomain) {
+		return msg, nil
+	}
+	return msg, err
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of a host, following its CNAMEs. A CNAME target that fails to resolve
+// one family still returns the addresses of the other, ErrIncompleteCNAME is returned if neither has addresses.
+// A *NotFoundError is returned with an empty slice if the host has no addresses
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	ips := []net.IP{}
+	seen := make(map[string]bool)
+	nxdomain, incomplete := false, false
+	for _, qtype := range []string{"A", "AAAA"} {
+		msg, err := r.resolve(host, qtype)
+		if errors.Is(err, ErrIncompleteCNAME) {
+			incomplete = true
+			continue
+		}
+		if err != nil {
+			return ips, err
+		}
+		nxdomain = IsNXDomain(msg)
+		for _, ip := range findIP(msg.Answer) {
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 && incomplete {
+		return ips, ErrIncompleteCNAME
+	}
+	if len(ips) == 0 {
+		return ips, &NotFoundError{Name: toLowerFQDN(host), NXDomain: nxdomain}
+	}
+	return ips, nil
+}
+
+// LookupAddr returns the host names of an IPv4 or IPv6 address, from the PTR records of its in-addr.arpa or ip6.arpa name.
+// A *NotFoundError is returned with an empty slice if the address has no PTR records
+func (r *Resolver) LookupAddr(ip string) ([]string, error) {
+	hosts := []string{}
+	if net.ParseIP(ip) == nil {
+		return hosts, fmt.Errorf("invalid IP address %q", ip)
+	}
+	name, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return hosts, err
+	}
+	msg, err := r.resolve(name, "PTR")
+	if err != nil {
+		return hosts, err
+	}
+	for _, rr := range filterRR(msg.Answer, dns.TypePTR) {
+		hosts = append(hosts, rr.(*dns.PTR).Ptr)
+	}
+	if len(hosts) == 0 {
+		return hosts, &NotFoundError{Name: name, NXDomain: IsNXDomain(msg)}
+	}
+	return hosts, nil
+}
+
+// LookupTXT returns the text of the TXT records of a name, the character strings of a record joined together.
+// A *NotFoundError is returned with an empty slice if the name has no TXT records
+func (r *Resolver) LookupTXT(name string) ([]string, error) {
+	texts := []string{}
+	msg, err := r.resolve(name, "TXT")
+	if err != nil {
+		return texts, err
+	}
+	for _, rr := range filterRR(msg.Answer, dns.TypeTXT) {
+		texts = append(texts, joinTXT(rr.(*dns.TXT).Txt))
+	}
+	if len(texts) == 0 {
+		return texts, &NotFoundError{Name: toLowerFQDN(name), NXDomain: IsNXDomain(msg)}
+	}
+	return texts, nil
+}
+
+// joinTXT joins the character strings of a TXT record, which are split only because a string holds at most
+// 255 bytes, so they are concatenated without a separator (RFC 7208 section 3.3)
+func joinTXT(txt []string) string {
+	var b strings.Builder
+	for _, t := range txt {
+		b.WriteString(unescapeTXT(t))
+	}
+	return b.String()
+}
+
+// unescapeTXT returns the bytes of a character string, which the dns package keeps in presentation format
+// with \X and \DDD escapes
+func unescapeTXT(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b = append(b, byte((s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0')))
+			i += 3
+			continue
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return string(b)
+}
+
+// isDigit returns true if the byte is a decimal digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// LookupSPF returns the SPF policies of a domain, published as v=spf1 TXT records. If SetSPFTypeFallback is enabled
+// and no policy is published as TXT, the deprecated SPF record type is looked up instead.
+// A *NotFoundError is returned with an empty slice if the domain has no policy
+func (r *Resolver) LookupSPF(domain string) ([]string, error) {
+	r.m.RLock()
+	fallback := r.spfFallback
+	r.m.RUnlock()
+
+	policies := []string{}
+	msg, err := r.resolve(domain, "TXT")
+	if err != nil {
+		return policies, err
+	}
+	nxdomain := IsNXDomain(msg)
+	for _, rr := range filterRR(msg.Answer, dns.TypeTXT) {
+		if policy := joinTXT(rr.(*dns.TXT).Txt); isSPF(policy) {
+			policies = append(policies, policy)
+		}
+	}
+	if len(policies) == 0 && fallback && !nxdomain {
+		msg, err := r.resolve(domain, "SPF")
+		if err != nil {
+			return policies, err
+		}
+		for _, rr := range filterRR(msg.Answer, dns.TypeSPF) {
+			if policy := joinTXT(rr.(*dns.SPF).Txt); isSPF(policy) {
+				policies = append(policies, policy)
+			}
+		}
+	}
+	if len(policies) == 0 {
+		return policies, &NotFoundError{Name: toLowerFQDN(domain), NXDomain: nxdomain}
+	}
+	return policies, nil
+}
+
+// isSPF returns true if the text is an SPF version 1 policy
+func isSPF(text string) bool {
+	text = strings.ToLower(text)
+	return text == "v=spf1" || strings.HasPrefix(text, "v=spf1 ")
+}
+
+// LookupRR resolves a record by name and type like Resolve, and returns the records of the answer, authority and
+// additional sections
+func (r *Resolver) LookupRR(name, qtype string) (answer, authority, additional []dns.RR, err error) {
+	msg, err := r.Resolve(name, qtype)
+	if msg == nil {
+		return nil, nil, nil, err
+	}
+	return msg.Answer, msg.Ns, msg.Extra, err
+}
+
+// LookupSRV returns the SRV records of _service._proto.name, sorted by priority and randomized by weight within a
+// priority as RFC 2782 describes. Like net.LookupSRV the name is looked up directly if service and proto are empty. The addresses of the targets
+// the nameserver included are cached, and added to the additional section when the SRV records are resolved again.
+// A *NotFoundError is returned with an empty slice if the name has no SRV records
+func (r *Resolver) LookupSRV(service, proto, name string) ([]*dns.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	srvs := []*dns.SRV{}
+	msg, err := r.resolve(target, "SRV")
+	if err != nil {
+		return srvs, err
+	}
+	for _, rr := range filterRR(msg.Answer, dns.TypeSRV) {
+		srvs = append(srvs, rr.(*dns.SRV))
+	}
+	if len(srvs) == 0 {
+		return srvs, &NotFoundError{Name: toLowerFQDN(target), NXDomain: IsNXDomain(msg)}
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Priority < srvs[j].Priority
+	})
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		r.shuffleByWeight(srvs[i:j])
+		i = j
+	}
+	return srvs, nil
+}
+
+// shuffleByWeight orders SRV records of the same priority at random, a record with a higher weight having a higher
+// chance to come first. Records with a weight of 0 are left at the end
+func (r *Resolver) shuffleByWeight(srvs []*dns.SRV) {
+	sum := 0
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+	for sum > 0 && len(srvs) > 1 {
+		n, s := r.intn(sum), 0
+		for i := range srvs {
+			s += int(srvs[i].Weight)
+			if s > n {
+				srvs[0], srvs[i] = srvs[i], srvs[0]
+				break
+			}
+		}
+		sum -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
+
+// ResolveMX returns the MX records of a domain to deliver mail to. ErrNullMX is returned if the domain publishes a
+// null MX record, stating it accepts no mail. A domain without MX records that has an address is its own mail server,
+// and gets an implicit MX record pointing to the domain itself (RFC 5321 section 5.1).
+// A *NotFoundError is returned with an empty slice if the domain has no MX records and no address
+func (r *Resolver) ResolveMX(domain string) ([]*dns.MX, error) {
+	domain = toLowerFQDN(domain)
+	mxs := []*dns.MX{}
+	msg, err := r.resolve(domain, "MX")
+	if err != nil {
+		return mxs, err
+	}
+	for _, rr := range filterRR(msg.Answer, dns.TypeMX) {
+		mx := rr.(*dns.MX)
+		if mx.Mx == "." {
+			return []*dns.MX{}, ErrNullMX
+		}
+		mxs = append(mxs, mx)
+	}
+	if len(mxs) > 0 {
+		return mxs, nil
+	}
+	if IsNXDomain(msg) {
+		return mxs, &NotFoundError{Name: domain, NXDomain: true}
+	}
+	for _, qtype := range []string{"A", "AAAA"} {
+		msg, err := r.resolve(domain, qtype)
+		if err != nil {
+			return mxs, err
+		}
+		if addrs := filterRR(msg.Answer, dns.StringToType[qtype]); len(addrs) > 0 {
+			hdr := dns.RR_Header{Name: domain, Ttl: addrs[0].Header().Ttl, Class: dns.ClassINET, Rrtype: dns.TypeMX}
+			return []*dns.MX{{Hdr: hdr, Preference: 0, Mx: domain}}, nil
+		}
+	}
+	return mxs, &NotFoundError{Name: domain}
+}
+
+// LookupMX returns the MX records of a domain, sorted by preference. Records of the same preference keep the order
+// of the answer. A *NotFoundError is returned with an empty slice if the domain has no MX records
+func (r *Resolver) LookupMX(name string) ([]*dns.MX, error) {
+	mxs := []*dns.MX{}
+	msg, err := r.resolve(name, "MX")
+	if err != nil {
+		return mxs, err
+	}
+	for _, rr := range filterRR(msg.Answer, dns.TypeMX) {
+		mxs = append(mxs, rr.(*dns.MX))
+	}
+	if len(mxs) == 0 {
+		return mxs, &NotFoundError{Name: toLowerFQDN(name), NXDomain: IsNXDomain(msg)}
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Preference < mxs[j].Preference
+	})
+	return mxs, nil
+}
+
+// LookupCAA returns the CAA records that apply to a name. If the name has no CAA records the parent domains are tried
+// up to the top level domain, the records of the closest domain apply (RFC 8659 section 3).
+// A *NotFoundError is returned with an empty slice if no domain has CAA records, any CA may then issue for the name
+func (r *Resolver) LookupCAA(name string) ([]*dns.CAA, error) {
+	name = toLowerFQDN(name)
+	caas := []*dns.CAA{}
+	for domain := name; domain != "."; {
+		msg, err := r.resolve(domain, "CAA")
+		if err != nil {
+			return caas, err
+		}
+		for _, rr := range filterRR(msg.Answer, dns.TypeCAA) {
+			caas = append(caas, rr.(*dns.CAA))
+		}
+		if len(caas) > 0 {
+			return caas, nil
+		}
+		domain, _ = parent(domain)
+	}
+	return caas, &NotFoundError{Name: name}
+}
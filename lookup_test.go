@@ -0,0 +1,317 @@
+package tinyresolver
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupIP(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN CNAME host.dns.test.",
+		"host.dns.test. 3600 IN A 10.10.10.10",
+		"host.dns.test. 3600 IN AAAA 2001:db8::10",
+		"mail.dns.test. 3600 IN MX 10 host.dns.test.",
+		"broken.dns.test. 3600 IN A 10.10.10.11",
+		"v4.dns.test. 3600 IN CNAME v4host.dns.test.",
+		"v4host.dns.test. 3600 IN A 10.10.10.12",
+		"half.dns.test. 3600 IN CNAME halfhost.dns.test.",
+		"halfhost.dns.test. 3600 IN A 10.10.10.13",
+		"halfhost.dns.test. 3600 IN AAAA 2001:db8::13",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		q := req.Question[0]
+		if q.Name != "broken.dns.test." && (q.Name != "halfhost.dns.test." || q.Qtype != dns.TypeAAAA) {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+		return true
+	})
+
+	ips, err := resolver.LookupIP("www.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ips))
+	assert.True(t, net.ParseIP("10.10.10.10").Equal(ips[0]))
+	assert.True(t, net.ParseIP("2001:db8::10").Equal(ips[1]))
+
+	// an alias of a host with only IPv4 addresses
+	ips, err = resolver.LookupIP("v4.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ips))
+	assert.True(t, net.ParseIP("10.10.10.12").Equal(ips[0]))
+
+	// the IPv6 address of the target fails to resolve, the IPv4 address is still returned
+	ips, err = resolver.LookupIP("half.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ips))
+	assert.True(t, net.ParseIP("10.10.10.13").Equal(ips[0]))
+
+	// the name exists, but has no addresses
+	ips, err = resolver.LookupIP("mail.dns.test")
+	assert.Equal(t, 0, len(ips))
+	assert.Equal(t, &NotFoundError{Name: "mail.dns.test."}, err)
+
+	ips, err = resolver.LookupIP("missing.dns.test")
+	assert.Equal(t, 0, len(ips))
+	assert.Equal(t, &NotFoundError{Name: "missing.dns.test.", NXDomain: true}, err)
+
+	// a failing server is an error, not a missing address
+	ips, err = resolver.LookupIP("broken.dns.test")
+	assert.Equal(t, 0, len(ips))
+	assert.NotNil(t, err)
+	_, notFound := err.(*NotFoundError)
+	assert.False(t, notFound)
+}
+
+func TestLookupSPF(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"txt.dns.test. 3600 IN TXT \"v=spf1 ip4:10.10.10.10 -all\"",
+		"txt.dns.test. 3600 IN TXT \"some-verification=1234\"",
+		"legacy.dns.test. 3600 IN SPF \"v=spf1 ip4:10.10.10.11 -all\"",
+	)
+
+	policies, err := resolver.LookupSPF("txt.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v=spf1 ip4:10.10.10.10 -all"}, policies)
+
+	// the SPF record type is only looked up when enabled
+	policies, err = resolver.LookupSPF("legacy.dns.test")
+	assert.Equal(t, 0, len(policies))
+	assert.Equal(t, &NotFoundError{Name: "legacy.dns.test."}, err)
+	assert.Equal(t, 0, server.received("legacy.dns.test.", "SPF"))
+
+	resolver.SetSPFTypeFallback(true)
+	policies, err = resolver.LookupSPF("legacy.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v=spf1 ip4:10.10.10.11 -all"}, policies)
+
+	// a TXT policy needs no fallback
+	_, err = resolver.LookupSPF("txt.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, server.received("txt.dns.test.", "SPF"))
+}
+
+func TestLookupRR(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"dns.test. 3600 IN MX 10 mail.dns.test.",
+		"mail.dns.test. 3600 IN A 10.10.10.10",
+	)
+
+	answer, _, additional, err := resolver.LookupRR("dns.test", "MX")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mail.dns.test."}, findMX(answer))
+	assert.Equal(t, []string{"10.10.10.10"}, findA(additional))
+
+	answer, authority, _, err := resolver.LookupRR("missing.dns.test", "A")
+	assert.True(t, errors.Is(err, ErrNXDomain))
+	assert.Equal(t, 0, len(answer))
+	assert.True(t, hasSOA(authority))
+}
+
+func TestLookupTXT(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"dns.test. 3600 IN TXT \"site-verification=1234\"",
+		"dkim.dns.test. 3600 IN TXT \"v=DKIM1; k=rsa; \" \"p=MIGfMA0GCSqGSIb3\"",
+		"spaces.dns.test. 3600 IN TXT \"text with\\009embedded  \\\"spaces\\\"\"",
+		"host.dns.test. 3600 IN A 10.10.10.10",
+	)
+
+	texts, err := resolver.LookupTXT("dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"site-verification=1234"}, texts)
+
+	// the character strings of a record are joined without a separator
+	texts, err = resolver.LookupTXT("dkim.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3"}, texts)
+
+	texts, err = resolver.LookupTXT("spaces.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"text with\tembedded  \"spaces\""}, texts)
+
+	texts, err = resolver.LookupTXT("host.dns.test")
+	assert.Equal(t, 0, len(texts))
+	assert.Equal(t, &NotFoundError{Name: "host.dns.test."}, err)
+}
+
+func TestLookupSRV(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"_sip._udp.dns.test. 3600 IN SRV 20 0 5060 backup.dns.test.",
+		"_sip._udp.dns.test. 3600 IN SRV 10 10 5060 small.dns.test.",
+		"_sip._udp.dns.test. 3600 IN SRV 10 60 5060 large.dns.test.",
+		"backup.dns.test. 3600 IN A 10.10.10.10",
+		"small.dns.test. 3600 IN A 10.10.10.11",
+		"large.dns.test. 3600 IN A 10.10.10.12",
+		"large.dns.test. 3600 IN AAAA 2001:db8::12",
+	)
+
+	// within a priority the order is random, the higher weight coming first more often
+	first := map[string]int{}
+	for i := 0; i < 200; i++ {
+		srvs, err := resolver.LookupSRV("sip", "udp", "dns.test")
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(srvs))
+		assert.Equal(t, "backup.dns.test.", srvs[2].Target)
+		first[srvs[0].Target]++
+	}
+	assert.True(t, first["large.dns.test."] > 140, "%v", first)
+	assert.True(t, first["small.dns.test."] > 0, "%v", first)
+	// records with a weight of 0 stay at the end
+	zero := []*dns.SRV{{Target: "zero.dns.test.", Weight: 0}, {Target: "five.dns.test.", Weight: 5}}
+	resolver.shuffleByWeight(zero)
+	assert.Equal(t, "five.dns.test.", zero[0].Target)
+
+	// the addresses of the targets that came with the answer are cached
+	msg, err := resolver.Resolve("_sip._udp.dns.test", "SRV")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, server.received("_sip._udp.dns.test.", "SRV"))
+	assert.ElementsMatch(t, []string{"10.10.10.10", "10.10.10.11", "10.10.10.12"}, findA(msg.Extra))
+	assert.Equal(t, []string{"2001:db8::12"}, findAAAA(msg.Extra))
+	ips, err := resolver.LookupIP("large.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ips))
+
+	// without service and proto the name is looked up as is
+	srvs, err := resolver.LookupSRV("", "", "_sip._udp.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(srvs))
+
+	srvs, err = resolver.LookupSRV("xmpp", "tcp", "dns.test")
+	assert.Equal(t, 0, len(srvs))
+	assert.Equal(t, &NotFoundError{Name: "_xmpp._tcp.dns.test.", NXDomain: true}, err)
+}
+
+func TestResolveMX(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"dns.test. 3600 IN MX 10 mail.dns.test.",
+		"mail.dns.test. 3600 IN A 10.10.10.10",
+		"nomail.dns.test. 3600 IN MX 0 .",
+		"nomail.dns.test. 3600 IN A 10.10.10.11",
+		"implicit.dns.test. 3600 IN AAAA 2001:db8::12",
+		"txt.dns.test. 3600 IN TXT \"no mail here\"",
+	)
+
+	mxs, err := resolver.ResolveMX("dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(mxs))
+	assert.Equal(t, "mail.dns.test.", mxs[0].Mx)
+
+	// a null MX refuses mail, even though the domain has an address
+	mxs, err = resolver.ResolveMX("nomail.dns.test")
+	assert.Equal(t, ErrNullMX, err)
+	assert.Equal(t, 0, len(mxs))
+
+	// without MX records the domain itself receives the mail
+	mxs, err = resolver.ResolveMX("implicit.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(mxs))
+	assert.Equal(t, "implicit.dns.test.", mxs[0].Mx)
+	assert.Equal(t, uint16(0), mxs[0].Preference)
+
+	// without an address there is no implicit MX
+	mxs, err = resolver.ResolveMX("txt.dns.test")
+	assert.Equal(t, 0, len(mxs))
+	assert.Equal(t, &NotFoundError{Name: "txt.dns.test."}, err)
+
+	mxs, err = resolver.ResolveMX("missing.dns.test")
+	assert.Equal(t, 0, len(mxs))
+	assert.Equal(t, &NotFoundError{Name: "missing.dns.test.", NXDomain: true}, err)
+}
+
+func TestLookupMX(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"dns.test. 3600 IN MX 20 backup.dns.test.",
+		"dns.test. 3600 IN MX 10 mx1.dns.test.",
+		"dns.test. 3600 IN MX 10 mx2.dns.test.",
+	)
+
+	mxs, err := resolver.LookupMX("dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(mxs))
+	assert.ElementsMatch(t, []string{"mx1.dns.test.", "mx2.dns.test."}, []string{mxs[0].Mx, mxs[1].Mx})
+	assert.Equal(t, uint16(10), mxs[1].Preference)
+	assert.Equal(t, "backup.dns.test.", mxs[2].Mx)
+
+	mxs, err = resolver.LookupMX("missing.dns.test")
+	assert.Equal(t, 0, len(mxs))
+	assert.Equal(t, &NotFoundError{Name: "missing.dns.test.", NXDomain: true}, err)
+}
+
+func TestLookupCAA(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"dns.test. 3600 IN CAA 0 issue \"ca.example.net\"",
+		"dns.test. 3600 IN CAA 128 iodef \"mailto:security@dns.test\"",
+		"own.dns.test. 3600 IN CAA 0 issue \";\"",
+		"www.sub.dns.test. 3600 IN A 10.10.10.10",
+	)
+
+	caas, err := resolver.LookupCAA("own.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(caas))
+	assert.Equal(t, "issue", caas[0].Tag)
+	assert.Equal(t, ";", caas[0].Value)
+
+	// the leaf has no CAA records, they are found at an ancestor
+	caas, err = resolver.LookupCAA("www.sub.dns.test")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(caas))
+	assert.Equal(t, uint8(0), caas[0].Flag)
+	assert.Equal(t, "issue", caas[0].Tag)
+	assert.Equal(t, "ca.example.net", caas[0].Value)
+	assert.Equal(t, uint8(128), caas[1].Flag)
+	assert.Equal(t, "iodef", caas[1].Tag)
+	assert.Equal(t, 1, server.received("www.sub.dns.test.", "CAA"))
+	assert.Equal(t, 1, server.received("sub.dns.test.", "CAA"))
+	assert.Equal(t, 1, server.received("dns.test.", "CAA"))
+
+	// no domain up to the top level domain has CAA records
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"www.test. 3600 IN A 10.10.10.10",
+	)
+	caas, err = mn.resolver("127.0.0.10").LookupCAA("www.test")
+	assert.Equal(t, 0, len(caas))
+	assert.Equal(t, &NotFoundError{Name: "www.test."}, err)
+}
+
+func TestLookupAddr(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"arpa. 3600 IN NS ns1.arpa.",
+		"ns1.arpa. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "arpa.",
+		"arpa. 3600 IN NS ns1.arpa.",
+		"ns1.arpa. 3600 IN A 127.0.0.11",
+		"10.10.10.10.in-addr.arpa. 3600 IN PTR www.dns.test.",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 3600 IN PTR mail.dns.test.",
+	)
+	resolver := mn.resolver("127.0.0.10")
+
+	hosts, err := resolver.LookupAddr("10.10.10.10")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"www.dns.test."}, hosts)
+
+	hosts, err = resolver.LookupAddr("2001:db8::1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mail.dns.test."}, hosts)
+
+	hosts, err = resolver.LookupAddr("10.10.10.11")
+	assert.Equal(t, 0, len(hosts))
+	assert.Equal(t, &NotFoundError{Name: "11.10.10.10.in-addr.arpa.", NXDomain: true}, err)
+
+	hosts, err = resolver.LookupAddr("www.dns.test")
+	assert.Equal(t, 0, len(hosts))
+	assert.EqualError(t, err, `invalid IP address "www.dns.test"`)
+}
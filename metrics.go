@@ -0,0 +1,155 @@
+package tinyresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// latencyBuckets are the upper bounds in seconds of the query latency histogram
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// metrics holds the internal counters of a resolver
+type metrics struct {
+	cacheHits   uint64
+	cacheMisses uint64
+	inFlight    int64
+	queries     uint64
+	loops       uint64
+	timeouts    uint64
+	m           sync.Mutex
+	rcodes      map[int]uint64
+	latency     latencyHistogram
+}
+
+// latencyHistogram holds the query latencies, buckets are counted per bucket and not cumulative
+type latencyHistogram struct {
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rcodes:  make(map[int]uint64),
+		latency: latencyHistogram{buckets: make([]uint64, len(latencyBuckets))},
+	}
+}
+
+// cacheHit counts a query answered from the cache
+func (m *metrics) cacheHit() {
+	atomic.AddUint64(&m.cacheHits, 1)
+}
+
+// cacheMiss counts a query that was not in the cache
+func (m *metrics) cacheMiss() {
+	atomic.AddUint64(&m.cacheMisses, 1)
+}
+
+// queryLoop counts a query that was stopped because it looped
+func (m *metrics) queryLoop() {
+	atomic.AddUint64(&m.loops, 1)
+}
+
+// queryStart counts a query sent to a nameserver, and returns the time it was sent
+func (m *metrics) queryStart() time.Time {
+	atomic.AddUint64(&m.queries, 1)
+	atomic.AddInt64(&m.inFlight, 1)
+	return time.Now()
+}
+
+// queryDone counts the response of a query started at start, or the timeout if it failed to get one in time
+func (m *metrics) queryDone(start time.Time, rmsg *dns.Msg, err error) {
+	atomic.AddInt64(&m.inFlight, -1)
+	seconds := time.Since(start).Seconds()
+	if isTimeout(err) {
+		atomic.AddUint64(&m.timeouts, 1)
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	if rmsg != nil {
+		m.rcodes[rmsg.Rcode]++
+	}
+	m.latency.count++
+	m.latency.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.latency.buckets[i]++
+			break
+		}
+	}
+}
+
+// isTimeout returns true if the error is a timeout of a query
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// metricsSnapshot is a copy of the metrics at a moment in time
+type metricsSnapshot struct {
+	cacheHits   uint64
+	cacheMisses uint64
+	inFlight    int64
+	loops       uint64
+	timeouts    uint64
+	rcodes      map[int]uint64
+	latency     latencyHistogram
+}
+
+// snapshot returns a copy of the metrics
+func (m *metrics) snapshot() metricsSnapshot {
+	s := metricsSnapshot{
+		cacheHits:   atomic.LoadUint64(&m.cacheHits),
+		cacheMisses: atomic.LoadUint64(&m.cacheMisses),
+		inFlight:    atomic.LoadInt64(&m.inFlight),
+		loops:       atomic.LoadUint64(&m.loops),
+		timeouts:    atomic.LoadUint64(&m.timeouts),
+		rcodes:      make(map[int]uint64),
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	for rcode, count := range m.rcodes {
+		s.rcodes[rcode] = count
+	}
+	s.latency = m.latency
+	s.latency.buckets = append([]uint64{}, m.latency.buckets...)
+	return s
+}
+
+// Stats are the counters of a resolver since it was created
+type Stats struct {
+	// CacheHits and CacheMisses count the queries that were and were not answered from the cache
+	CacheHits   uint64
+	CacheMisses uint64
+	// Queries counts the queries sent to nameservers
+	Queries uint64
+	// Loops counts the queries that were stopped because they looped
+	Loops uint64
+	// Timeouts counts the queries to nameservers that did not get a response in time
+	Timeouts uint64
+}
+
+// Stats returns the counters of the resolver, reading them does not block resolving
+func (r *Resolver) Stats() Stats {
+	m := r.metrics
+	return Stats{
+		CacheHits:   atomic.LoadUint64(&m.cacheHits),
+		CacheMisses: atomic.LoadUint64(&m.cacheMisses),
+		Queries:     atomic.LoadUint64(&m.queries),
+		Loops:       atomic.LoadUint64(&m.loops),
+		Timeouts:    atomic.LoadUint64(&m.timeouts),
+	}
+}
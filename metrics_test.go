@@ -0,0 +1,51 @@
+package tinyresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+		"slow.dns.test. 3600 IN A 10.10.10.11",
+	)
+	// the server never answers for slow
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		return req.Question[0].Name == "slow.dns.test."
+	})
+
+	_, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	stats := resolver.Stats()
+	assert.True(t, stats.CacheMisses > 0)
+	// at least the root and the test. server were asked
+	assert.True(t, stats.Queries >= 2)
+
+	// the second time the answer comes from the cache
+	_, err = resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.True(t, resolver.Stats().CacheHits > stats.CacheHits)
+	assert.Equal(t, stats.Queries, resolver.Stats().Queries)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = resolver.ResolveContext(ctx, "slow.dns.test", "A")
+	assert.NotNil(t, err)
+	// the query in flight times out after the resolution returned
+	assert.Eventually(t, func() bool { return resolver.Stats().Timeouts == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(0), resolver.Stats().Loops)
+
+	// a query that loops is stopped and counted
+	qs := resolver.newResolveState(ResolveOptions{})
+	for i := 0; i < 5; i++ {
+		qs.count("loop.dns.test.", "A")
+	}
+	_, err = resolver.queryWithCache(context.Background(), "loop.dns.test.", "A", 0, qs)
+	assert.Equal(t, ErrQueryLoop, err)
+	assert.Equal(t, uint64(1), resolver.Stats().Loops)
+}
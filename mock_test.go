@@ -0,0 +1,319 @@
+package tinyresolver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mockNet is a set of in-process nameservers on loopback addresses, all listening on the same port
+type mockNet struct {
+	t       testing.TB
+	port    string
+	servers map[string]*mockServer
+}
+
+// mockServer is an in-process nameserver, serving the records of a single zone
+type mockServer struct {
+	ip   string
+	zone string
+	rrs  []dns.RR
+	// handler can take over a request, returning true if it has handled it
+	handler func(w dns.ResponseWriter, req *dns.Msg) bool
+	m       sync.Mutex
+	queries []*dns.Msg
+}
+
+// newMockNet returns an empty mock network on a free port
+func newMockNet(t testing.TB) *mockNet {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+	return &mockNet{
+		t:       t,
+		port:    port,
+		servers: make(map[string]*mockServer),
+	}
+}
+
+// addServer starts a nameserver on ip, authoritative for zone with the given records in zone file format
+func (mn *mockNet) addServer(ip, zone string, records ...string) *mockServer {
+	s := &mockServer{
+		ip:   ip,
+		zone: toLowerFQDN(zone),
+	}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			mn.t.Fatalf("invalid record %q: %s", record, err)
+		}
+		rr.Header().Name = toLowerFQDN(rr.Header().Name)
+		s.rrs = append(s.rrs, rr)
+	}
+	if len(s.find(s.zone, dns.TypeSOA)) == 0 {
+		// like most zones, the primary nameserver in the SOA is one of the zone's nameservers
+		primary := dns.Fqdn("ns." + s.zone)
+		if ns := findNS(s.find(s.zone, dns.TypeNS)); len(ns) > 0 {
+			primary = ns[0]
+		}
+		s.rrs = append(s.rrs, &dns.SOA{Hdr: dns.RR_Header{Name: s.zone, Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeSOA}, Ns: primary, Mbox: dns.Fqdn("hostmaster." + s.zone), Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 300})
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: net.JoinHostPort(ip, mn.port), Net: network, Handler: s}
+		started := make(chan error, 1)
+		srv.NotifyStartedFunc = func() { started <- nil }
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				started <- err
+			}
+		}()
+		if err := <-started; err != nil {
+			mn.t.Fatalf("failed to start mock server %s/%s: %s", ip, network, err)
+		}
+		mn.t.Cleanup(func() { srv.Shutdown() })
+	}
+	mn.servers[ip] = s
+	return s
+}
+
+// addTLSServer serves the zone of a mock server over TLS as well, with a certificate for its address and the names.
+// It returns the port of the TLS server and the pool trusting its certificate
+func (mn *mockNet) addTLSServer(s *mockServer, names ...string) (string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		mn.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP(s.ip)},
+		DNSNames:              names,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		mn.t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	l, err := net.Listen("tcp", net.JoinHostPort(s.ip, "0"))
+	if err != nil {
+		mn.t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv := &dns.Server{Listener: tls.NewListener(l, config), Net: "tcp-tls", Handler: s}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	mn.t.Cleanup(func() { srv.Shutdown() })
+	return port, pool
+}
+
+// resolver returns a resolver using the mock server on rootIP as the only root server
+func (mn *mockNet) resolver(rootIP string) *Resolver {
+	r := New()
+	r.port = mn.port
+	r.cache = newCacheWithRoot([]dns.RR{
+		&dns.NS{Hdr: dns.RR_Header{Name: ".", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeNS}, Ns: "mock.root-servers.test."},
+		&dns.A{Hdr: dns.RR_Header{Name: "mock.root-servers.test.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP(rootIP)},
+	})
+	return r
+}
+
+// newMockResolver starts a mock root delegating test. to a mock server holding the given records,
+// and returns a resolver using that root together with the test. server
+func newMockResolver(t *testing.T, records ...string) (*Resolver, *mockServer) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	s := mn.addServer("127.0.0.11", "test.", append([]string{
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	}, records...)...)
+	return mn.resolver("127.0.0.10"), s
+}
+
+// ServeDNS answers a request from the zone data, unless the handler takes over
+func (s *mockServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.m.Lock()
+	s.queries = append(s.queries, req.Copy())
+	handler := s.handler
+	s.m.Unlock()
+	if handler != nil && handler(w, req) {
+		return
+	}
+	resp := s.answer(req)
+	// like real nameservers the EDNS record of the request is answered with one of the server
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	w.WriteMsg(resp)
+}
+
+// answer builds the authoritative answer or referral for a request
+func (s *mockServer) answer(req *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	q := req.Question[0]
+	qname := toLowerFQDN(q.Name)
+
+	// names below a delegation get a referral to the delegated nameservers, the DS records of the delegation
+	// are answered by the parent
+	for _, rr := range s.rrs {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype == dns.TypeNS && owner != s.zone && dns.IsSubDomain(owner, qname) && (q.Qtype != dns.TypeDS || owner != qname) {
+			resp.Ns = s.find(owner, dns.TypeNS)
+			resp.Extra = s.glue(resp.Ns)
+			return resp
+		}
+	}
+
+	resp.Authoritative = true
+	resp.Answer = s.find(qname, q.Qtype)
+	if len(resp.Answer) == 0 && q.Qtype != dns.TypeCNAME {
+		resp.Answer = s.find(qname, dns.TypeCNAME)
+	}
+	if len(resp.Answer) > 0 {
+		if opt := req.IsEdns0(); opt != nil && opt.Do() {
+			resp.Answer = append(resp.Answer, s.signatures(resp.Answer)...)
+		}
+		resp.Extra = s.glue(resp.Answer)
+		return resp
+	}
+	resp.Ns = s.find(s.zone, dns.TypeSOA)
+	if !s.exists(qname) {
+		resp.Rcode = dns.RcodeNameError
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		resp.Ns = append(resp.Ns, s.proofs(qname, resp.Rcode == dns.RcodeNameError)...)
+	}
+	return resp
+}
+
+// proofs returns the NSEC records and their signatures that prove a NODATA answer for the name, or that cover the
+// name for a NXDOMAIN answer
+func (s *mockServer) proofs(name string, nxdomain bool) (res []dns.RR) {
+	for _, rr := range s.rrs {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok || (nxdomain && !nsecCovers(nsec, name)) || (!nxdomain && nsec.Hdr.Name != name) {
+			continue
+		}
+		res = append(res, dns.Copy(rr))
+		res = append(res, s.signatures([]dns.RR{rr})...)
+	}
+	return
+}
+
+// signatures returns copies of the RRSIG records covering the records
+func (s *mockServer) signatures(rrs []dns.RR) (res []dns.RR) {
+	for _, rr := range s.rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || sig.Hdr.Name != rrs[0].Header().Name || sig.TypeCovered != rrs[0].Header().Rrtype {
+			continue
+		}
+		res = append(res, dns.Copy(rr))
+	}
+	return
+}
+
+// find returns copies of the records matching name and type
+func (s *mockServer) find(name string, qtype uint16) (res []dns.RR) {
+	for _, rr := range s.rrs {
+		if rr.Header().Name == name && rr.Header().Rrtype == qtype {
+			res = append(res, dns.Copy(rr))
+		}
+	}
+	return
+}
+
+// glue returns the addresses known for the targets of NS, MX and SRV records
+func (s *mockServer) glue(rrs []dns.RR) (res []dns.RR) {
+	for _, rr := range rrs {
+		target := ""
+		switch v := rr.(type) {
+		case *dns.NS:
+			target = v.Ns
+		case *dns.MX:
+			target = v.Mx
+		case *dns.SRV:
+			target = v.Target
+		default:
+			continue
+		}
+		res = append(res, s.find(toLowerFQDN(target), dns.TypeA)...)
+		res = append(res, s.find(toLowerFQDN(target), dns.TypeAAAA)...)
+	}
+	return
+}
+
+// exists returns true if the name, or a name below it, has records
+func (s *mockServer) exists(name string) bool {
+	for _, rr := range s.rrs {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHandler sets the handler that can take over requests
+func (s *mockServer) setHandler(handler func(w dns.ResponseWriter, req *dns.Msg) bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.handler = handler
+}
+
+// received returns the number of queries received for name and type
+func (s *mockServer) received(name, qtype string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	count := 0
+	for _, q := range s.queries {
+		if toLowerFQDN(q.Question[0].Name) == toLowerFQDN(name) && q.Question[0].Qtype == dns.StringToType[qtype] {
+			count++
+		}
+	}
+	return count
+}
+
+// lastQuery returns the last query received for name and type, nil if there was none
+func (s *mockServer) lastQuery(name, qtype string) *dns.Msg {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i := len(s.queries) - 1; i >= 0; i-- {
+		q := s.queries[i].Question[0]
+		if toLowerFQDN(q.Name) == toLowerFQDN(name) && q.Qtype == dns.StringToType[qtype] {
+			return s.queries[i]
+		}
+	}
+	return nil
+}
+
+// String returns the address of the mock server
+func (s *mockServer) String() string {
+	return fmt.Sprintf("%s (%s)", s.ip, s.zone)
+}
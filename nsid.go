@@ -0,0 +1,46 @@
+package tinyresolver
+
+import (
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+// requestNSID asks the nameserver for its identifier, the message must have an OPT record
+func requestNSID(qmsg *dns.Msg) {
+	if opt := qmsg.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	}
+}
+
+// nsidOf returns the identifier of the nameserver that sent a response, or an empty string if it has none.
+// The identifier is returned as text, unless it is not printable in which case it stays hex encoded
+func nsidOf(msg *dns.Msg) string {
+	if msg == nil {
+		return ""
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+			raw, err := hex.DecodeString(nsid.Nsid)
+			if err != nil || !printable(raw) {
+				return nsid.Nsid
+			}
+			return string(raw)
+		}
+	}
+	return ""
+}
+
+// printable returns true if all bytes are printable ASCII
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package tinyresolver
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNSID(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	// the server identifies itself if asked to
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		resp := server.answer(req)
+		opt := req.IsEdns0()
+		if opt == nil {
+			return false
+		}
+		for _, o := range opt.Option {
+			if _, ok := o.(*dns.EDNS0_NSID); ok {
+				resp.SetEdns0(EDNSBufferSize, false)
+				ropt := resp.IsEdns0()
+				ropt.Option = append(ropt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte("ams-node-1"))})
+			}
+		}
+		w.WriteMsg(resp)
+		return true
+	})
+
+	result, err := resolver.ResolveFull(context.Background(), "www.dns.test", "A", WithNSID(true))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(result.Msg.Answer))
+	assert.Equal(t, "ams-node-1", result.NSID)
+
+	// answers from the cache did not come from a server
+	result, err = resolver.ResolveFull(context.Background(), "www.dns.test", "A", WithNSID(true))
+	assert.Nil(t, err)
+	assert.Equal(t, "", result.NSID)
+
+	// a binary identifier stays hex encoded
+	msg := &dns.Msg{}
+	msg.SetEdns0(EDNSBufferSize, false)
+	msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "00ff"})
+	assert.Equal(t, "00ff", nsidOf(msg))
+}
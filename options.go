@@ -0,0 +1,209 @@
+package tinyresolver
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Section selects sections of a message, sections can be combined
+type Section int
+
+// The sections of a message
+const (
+	SectionAnswer Section = 1 << iota
+	SectionAuthority
+	SectionAdditional
+)
+
+// ResolveOptions are options that only apply to a single resolution
+type ResolveOptions struct {
+	// BlockedNameservers are the nameserver IPs that are never queried
+	BlockedNameservers []net.IP
+	// DNSSEC sets the DO bit, so nameservers include the RRSIG records of the answer
+	DNSSEC bool
+	// Sections are the sections of the message that are returned, 0 returns all sections.
+	// Leaving out the additional section skips looking up the addresses of MX, NS, SRV and CNAME targets
+	Sections Section
+	// Timeout is the time the resolution is allowed to take, 0 uses the timeout of the resolver
+	Timeout time.Duration
+	// MaxDepth is the max recursive depth to query, 0 uses the max depth of the resolver
+	MaxDepth int
+	// NoCNAMEFollow returns the CNAME of an alias without resolving its target
+	NoCNAMEFollow bool
+	// Forwarders are the servers the queries are sent to asking them to recurse, instead of finding the nameservers
+	Forwarders []string
+	// NSID asks the nameservers for their identifier (RFC 5001), to find which node of an anycast cluster answered
+	NSID bool
+	// EDNSBufferSize is the UDP payload size advertised to nameservers, 0 uses the buffer size of the resolver.
+	// A larger buffer avoids retrying large answers over TCP, a smaller one avoids fragmented UDP packets
+	EDNSBufferSize uint16
+}
+
+// Option sets an option of a single resolution
+type Option func(*ResolveOptions)
+
+// WithBlockedNameservers never queries the nameserver IPs
+func WithBlockedNameservers(ips ...net.IP) Option {
+	return func(o *ResolveOptions) {
+		o.BlockedNameservers = append(o.BlockedNameservers, ips...)
+	}
+}
+
+// WithDNSSEC sets the DO bit, so nameservers include the RRSIG records of the answer
+func WithDNSSEC(enable bool) Option {
+	return func(o *ResolveOptions) {
+		o.DNSSEC = enable
+	}
+}
+
+// WithSections returns only the sections of the message
+func WithSections(sections Section) Option {
+	return func(o *ResolveOptions) {
+		o.Sections = sections
+	}
+}
+
+// WithTimeout sets the time the resolution is allowed to take
+func WithTimeout(d time.Duration) Option {
+	return func(o *ResolveOptions) {
+		o.Timeout = d
+	}
+}
+
+// WithMaxDepth sets the max recursive depth to query
+func WithMaxDepth(depth int) Option {
+	return func(o *ResolveOptions) {
+		o.MaxDepth = depth
+	}
+}
+
+// WithFollowCNAME sets if the target of a CNAME is resolved, which it is by default
+func WithFollowCNAME(follow bool) Option {
+	return func(o *ResolveOptions) {
+		o.NoCNAMEFollow = !follow
+	}
+}
+
+// WithForwarders sends the queries to the servers asking them to recurse, instead of finding the nameservers
+func WithForwarders(servers ...string) Option {
+	return func(o *ResolveOptions) {
+		o.Forwarders = append(o.Forwarders, servers...)
+	}
+}
+
+// WithNSID asks the nameservers for their identifier, which is returned in the result
+func WithNSID(enable bool) Option {
+	return func(o *ResolveOptions) {
+		o.NSID = enable
+	}
+}
+
+// WithEDNSBufferSize sets the UDP payload size advertised to nameservers
+func WithEDNSBufferSize(size uint16) Option {
+	return func(o *ResolveOptions) {
+		o.EDNSBufferSize = size
+	}
+}
+
+// ResolveResult is the result of ResolveFull
+type ResolveResult struct {
+	// Msg is the resolved message
+	Msg *dns.Msg
+	// Name is the name that was resolved, which is the queried name extended by a search domain if it was used
+	Name string
+	// Duration is the time the resolution took
+	Duration time.Duration
+	// NSID is the identifier of the nameserver that answered, if asked for with WithNSID.
+	// It is empty if the answer came from the cache or the nameserver has none
+	NSID string
+}
+
+// wants returns true if the section should be returned
+func (o ResolveOptions) wants(section Section) bool {
+	return o.Sections == 0 || o.Sections&section != 0
+}
+
+// blocked returns true if the nameserver ip is blocked
+func (o ResolveOptions) blocked(ip string) bool {
+	nsip := net.ParseIP(ip)
+	for _, b := range o.BlockedNameservers {
+		if b.Equal(nsip) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxDepth returns the max recursive depth of the resolution
+func (o ResolveOptions) maxDepth() int {
+	if o.MaxDepth > 0 {
+		return o.MaxDepth
+	}
+	return MaxDepth
+}
+
+// ednsBufferSize returns the UDP payload size advertised to nameservers
+func (o ResolveOptions) ednsBufferSize() uint16 {
+	if o.EDNSBufferSize >= dns.MinMsgSize {
+		return o.EDNSBufferSize
+	}
+	if o.EDNSBufferSize > 0 {
+		return dns.MinMsgSize
+	}
+	return EDNSBufferSize
+}
+
+// ResolveWithOptions resolves a record by name and type like Resolve, using the options for this resolution only
+func (r *Resolver) ResolveWithOptions(qname, qtype string, opts ResolveOptions) (*dns.Msg, error) {
+	result, err := r.resolveSearch(context.Background(), qname, qtype, opts)
+	if result == nil {
+		return nil, err
+	}
+	return result.Msg, err
+}
+
+// ResolveFull resolves a record by name and type like Resolve within the context, using the options for this resolution only
+func (r *Resolver) ResolveFull(ctx context.Context, qname, qtype string, opts ...Option) (*ResolveResult, error) {
+	var o ResolveOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	start := time.Now()
+	result, err := r.resolveSearch(ctx, qname, qtype, o)
+	if result == nil {
+		return nil, err
+	}
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+// resolveSearch resolves a record within the timeout of the options, trying the search domains for names that are not fully qualified.
+// The result is nil if there is no message
+func (r *Resolver) resolveSearch(ctx context.Context, qname, qtype string, opts ResolveOptions) (*ResolveResult, error) {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = r.queryTimeout()
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var msg *dns.Msg
+	var name string
+	var err error
+	var qs *queryState
+	// names that are not fully qualified are tried with the search domains until one has an answer
+	for _, name = range r.searchNames(qname) {
+		qs = r.newResolveState(opts)
+		msg, err = r.resolveWithContext(ctx, name, qtype, 0, qs)
+		if err == nil && len(msg.Answer) > 0 {
+			break
+		}
+	}
+	if msg == nil {
+		return nil, err
+	}
+	return &ResolveResult{Msg: msg, Name: name, NSID: qs.nsid(name, qtype)}, err
+}
@@ -0,0 +1,164 @@
+package tinyresolver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockedNameservers(t *testing.T) {
+	mn := newMockNet(t)
+	delegation := []string{
+		"test. 3600 IN NS ns1.test.",
+		"test. 3600 IN NS ns2.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"ns2.test. 3600 IN A 127.0.0.12",
+	}
+	mn.addServer("127.0.0.10", ".", delegation...)
+	zone := append([]string{"host.test. 3600 IN A 10.10.10.10"}, delegation...)
+	blocked := mn.addServer("127.0.0.11", "test.", zone...)
+	allowed := mn.addServer("127.0.0.12", "test.", zone...)
+
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetShuffleNameservers(false)
+	rr, err := resolver.ResolveWithOptions("host.test", "A", ResolveOptions{
+		BlockedNameservers: []net.IP{net.ParseIP("127.0.0.11")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 0, blocked.received("host.test.", "A"))
+	assert.Equal(t, 1, allowed.received("host.test.", "A"))
+
+	// the block only applies to the resolution it was given to
+	resolver.cache = mn.resolver("127.0.0.10").cache
+	_, err = resolver.ResolveWithOptions("host.test", "A", ResolveOptions{
+		BlockedNameservers: []net.IP{net.ParseIP("127.0.0.12")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, blocked.received("host.test.", "A"))
+	assert.Equal(t, 1, allowed.received("host.test.", "A"))
+}
+
+func TestResolveSections(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"dns.test. 3600 IN MX 10 mail.dns.test.",
+		"mail.dns.test. 3600 IN A 10.10.10.10",
+	)
+
+	// the first resolution caches the MX record and the address of its target
+	rr, err := resolver.Resolve("dns.test", "MX")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Extra))
+
+	// the cached address is not looked up when only the answer is wanted
+	rr, err = resolver.ResolveWithOptions("dns.test", "MX", ResolveOptions{Sections: SectionAnswer})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mail.dns.test."}, findMX(rr.Answer))
+	assert.Equal(t, 0, len(rr.Extra))
+	assert.Equal(t, 0, len(rr.Ns))
+	assert.Equal(t, 0, len(resolver.cache.lookup("dns.test.", "MX", false, true).Extra))
+	assert.Equal(t, 1, len(resolver.cache.lookup("dns.test.", "MX", true, true).Extra))
+
+	rr, err = resolver.ResolveWithOptions("dns.test", "MX", ResolveOptions{Sections: SectionAnswer | SectionAdditional})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Extra))
+}
+
+func TestResolveFull(t *testing.T) {
+	mn := newMockNet(t)
+	root := mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"alias.test. 3600 IN CNAME www.other.test.",
+		"www.other.test. 3600 IN A 10.10.10.10",
+	)
+	forwarder := mn.addServer("127.0.0.21", ".",
+		"host.internal. 3600 IN A 192.168.0.10",
+	)
+	slow := mn.addServer("127.0.0.22", ".")
+	slow.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		time.Sleep(time.Second)
+		return false
+	})
+	resolver := mn.resolver("127.0.0.10")
+	ctx := context.Background()
+
+	// the cname is returned without its target
+	result, err := resolver.ResolveFull(ctx, "alias.test", "A", WithFollowCNAME(false))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"www.other.test."}, findCNAME(result.Msg.Answer))
+	assert.Equal(t, 0, len(findA(result.Msg.Answer)))
+	assert.Equal(t, "alias.test.", result.Name)
+
+	result, err = resolver.ResolveFull(ctx, "alias.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(result.Msg.Answer))
+
+	// the forwarder is asked to recurse, instead of the root
+	result, err = resolver.ResolveFull(ctx, "host.internal", "A", WithForwarders("127.0.0.21"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.0.10"}, findA(result.Msg.Answer))
+	assert.Equal(t, 0, root.received("host.internal.", "A"))
+	forwarder.m.Lock()
+	assert.True(t, forwarder.queries[0].RecursionDesired)
+	forwarder.m.Unlock()
+
+	// the delegation is deeper than allowed
+	_, err = mn.resolver("127.0.0.10").ResolveFull(ctx, "alias.test", "A", WithMaxDepth(1))
+	assert.Equal(t, ErrMaxDepth, err)
+
+	start := time.Now()
+	_, err = resolver.ResolveFull(ctx, "host.slow", "A", WithForwarders("127.0.0.22"), WithTimeout(100*time.Millisecond))
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestResolveCancelled(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := resolver.ResolveFull(ctx, "www.dns.test", "A")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, server.received("www.dns.test.", "A"))
+	// not even the cache was looked at
+	stats := resolver.metrics.snapshot()
+	assert.Equal(t, uint64(0), stats.cacheHits+stats.cacheMisses)
+}
+
+func TestEDNSBufferSize(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"small.dns.test. 3600 IN A 10.10.10.10",
+		"large.dns.test. 3600 IN TXT \"large\"",
+	)
+	resolver.SetEDNSBufferSize(4096)
+	bufferSize := func(name string) uint16 {
+		server.m.Lock()
+		defer server.m.Unlock()
+		for _, q := range server.queries {
+			if q.Question[0].Name == name && q.IsEdns0() != nil {
+				return q.IsEdns0().UDPSize()
+			}
+		}
+		return 0
+	}
+
+	_, err := resolver.Resolve("large.dns.test", "TXT")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(4096), bufferSize("large.dns.test."))
+
+	// the buffer size of the call overrides the resolver
+	_, err = resolver.ResolveFull(context.Background(), "small.dns.test", "A", WithEDNSBufferSize(1232))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1232), bufferSize("small.dns.test."))
+}
@@ -0,0 +1,77 @@
+//go:build prometheus
+// +build prometheus
+
+package tinyresolver
+
+import (
+	"strconv"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHitsDesc     = prometheus.NewDesc("tinyresolver_cache_hits_total", "Number of lookups answered from the cache.", nil, nil)
+	cacheMissesDesc   = prometheus.NewDesc("tinyresolver_cache_misses_total", "Number of lookups not found in the cache.", nil, nil)
+	cacheHitRatioDesc = prometheus.NewDesc("tinyresolver_cache_hit_ratio", "Ratio of lookups answered from the cache.", nil, nil)
+	inFlightDesc      = prometheus.NewDesc("tinyresolver_queries_in_flight", "Number of queries waiting for a nameserver.", nil, nil)
+	responsesDesc     = prometheus.NewDesc("tinyresolver_responses_total", "Number of nameserver responses by rcode.", []string{"rcode"}, nil)
+	loopsDesc         = prometheus.NewDesc("tinyresolver_query_loops_total", "Number of queries stopped because they looped.", nil, nil)
+	timeoutsDesc      = prometheus.NewDesc("tinyresolver_query_timeouts_total", "Number of queries to nameservers that timed out.", nil, nil)
+	latencyDesc       = prometheus.NewDesc("tinyresolver_query_duration_seconds", "Latency of the queries sent to nameservers.", nil, nil)
+)
+
+// collector exposes the metrics of a resolver to prometheus
+type collector struct {
+	r *Resolver
+}
+
+// Collector returns a prometheus collector for the metrics of the resolver, it is only available with the prometheus build tag
+func (r *Resolver) Collector() prometheus.Collector {
+	return &collector{r: r}
+}
+
+// Describe implements prometheus.Collector
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheHitRatioDesc
+	ch <- inFlightDesc
+	ch <- responsesDesc
+	ch <- loopsDesc
+	ch <- timeoutsDesc
+	ch <- latencyDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.r.metrics.snapshot()
+
+	ratio := 0.0
+	if total := s.cacheHits + s.cacheMisses; total > 0 {
+		ratio = float64(s.cacheHits) / float64(total)
+	}
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(s.cacheHits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(s.cacheMisses))
+	ch <- prometheus.MustNewConstMetric(cacheHitRatioDesc, prometheus.GaugeValue, ratio)
+	ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(s.inFlight))
+	ch <- prometheus.MustNewConstMetric(loopsDesc, prometheus.CounterValue, float64(s.loops))
+	ch <- prometheus.MustNewConstMetric(timeoutsDesc, prometheus.CounterValue, float64(s.timeouts))
+
+	for rcode, count := range s.rcodes {
+		name, ok := dns.RcodeToString[rcode]
+		if !ok {
+			name = strconv.Itoa(rcode)
+		}
+		ch <- prometheus.MustNewConstMetric(responsesDesc, prometheus.CounterValue, float64(count), name)
+	}
+
+	// prometheus expects cumulative bucket counts
+	buckets := make(map[float64]uint64, len(latencyBuckets))
+	cumulative := uint64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += s.latency.buckets[i]
+		buckets[bound] = cumulative
+	}
+	ch <- prometheus.MustNewConstHistogram(latencyDesc, s.latency.count, s.latency.sum, buckets)
+}
@@ -0,0 +1,59 @@
+//go:build prometheus
+// +build prometheus
+
+package tinyresolver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	registry := prometheus.NewRegistry()
+	assert.Nil(t, registry.Register(resolver.Collector()))
+
+	for i := 0; i < 2; i++ {
+		_, err := resolver.Resolve("www.dns.test", "A")
+		assert.Nil(t, err)
+	}
+	_, err := resolver.Resolve("missing.dns.test", "A")
+	assert.True(t, errors.Is(err, ErrNXDomain))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	found := map[string]bool{}
+	for _, family := range families {
+		found[family.GetName()] = true
+		switch family.GetName() {
+		case "tinyresolver_cache_hits_total":
+			assert.True(t, family.GetMetric()[0].GetCounter().GetValue() > 0)
+		case "tinyresolver_query_duration_seconds":
+			assert.True(t, family.GetMetric()[0].GetHistogram().GetSampleCount() > 0)
+		case "tinyresolver_responses_total":
+			rcodes := map[string]bool{}
+			for _, m := range family.GetMetric() {
+				rcodes[m.GetLabel()[0].GetValue()] = true
+			}
+			assert.True(t, rcodes["NOERROR"])
+			assert.True(t, rcodes["NXDOMAIN"])
+		}
+	}
+	for _, name := range []string{
+		"tinyresolver_cache_hits_total",
+		"tinyresolver_cache_misses_total",
+		"tinyresolver_cache_hit_ratio",
+		"tinyresolver_queries_in_flight",
+		"tinyresolver_responses_total",
+		"tinyresolver_query_loops_total",
+		"tinyresolver_query_timeouts_total",
+		"tinyresolver_query_duration_seconds",
+	} {
+		assert.True(t, found[name], name)
+	}
+}
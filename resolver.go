@@ -2,17 +2,22 @@ package tinyresolver
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -24,6 +29,16 @@ const (
 
 	// MaxNameservers is the max name servers to query simultainiously
 	MaxNameservers = 4
+
+	// MaxNSLookups is the max distinct nameserver names a single resolution resolves the address of
+	MaxNSLookups = 20
+
+	// MaxMinimizeLabels is the max labels below the closest known zone a name is walked down label by label with QNAME
+	// minimization, each label is a level deeper in the recursion. Longer names such as those in ip6.arpa are sent in full
+	MaxMinimizeLabels = 5
+
+	// EDNSBufferSize is the UDP payload size advertised to nameservers
+	EDNSBufferSize = 1232
 )
 
 // Various errors
@@ -32,127 +47,1226 @@ var (
 	ErrMaxParent = errors.New("Max parent reached")
 	ErrNoNS      = errors.New("no NS record found for domain")
 	ErrQueryLoop = errors.New("loop in query")
+	// ErrIncompleteCNAME is returned together with the partial answer when the target of a followed CNAME could not be resolved
+	ErrIncompleteCNAME = errors.New("failed to resolve cname target")
+	ErrRefused         = errors.New("refused, name is not in a served zone")
+	ErrInvalidResponse = errors.New("invalid response")
+	ErrBlocked         = errors.New("nameserver is blocked")
+	ErrMaxNSLookups    = errors.New("too many nameserver address lookups")
+	ErrNoRootHints     = errors.New("root hints have no root nameserver with an address")
+	// ErrNXDomain and ErrServFail match the *DNSError returned for a name that does not exist or a nameserver failure,
+	// use errors.Is to check for them
+	ErrNXDomain = errors.New("name does not exist")
+	ErrServFail = errors.New("server failure")
+	// ErrNullMX is returned when a domain publishes a null MX record (RFC 7505), stating it accepts no mail
+	ErrNullMX = errors.New("domain accepts no mail")
+	// ErrDNSSECBogus matches the *DNSSECError returned when an answer fails DNSSEC validation
+	ErrDNSSECBogus   = errors.New("DNSSEC validation failed")
+	ErrNoTrustAnchor = errors.New("no DS or DNSKEY trust anchor found")
 )
 
+// contextKey is the type of the values the resolver stores in a context
+type contextKey int
+
+// recursionDesiredKey marks a context of queries that are sent with the RD bit
+const recursionDesiredKey contextKey = iota
+
+// Logger is where the resolver writes its debug logging to
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// stdLogger writes to the standard logger of the log package
+type stdLogger struct{}
+
+// Printf writes to the standard logger
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
 // Resolver is the resolver object
 type Resolver struct {
-	timeout time.Duration
-	cache   *cache
-	debug   bool
-	m       sync.RWMutex
+	timeout        time.Duration
+	cache          *cache
+	debug          atomic.Bool
+	logger         Logger
+	shuffle        bool
+	enricher       func(net.IP) map[string]string
+	maxRecords     int
+	port           string
+	maxGoroutines  int
+	authOnly       bool
+	stagger        time.Duration
+	sequential     bool
+	strict         bool
+	noMinimize     bool
+	dnssec         bool
+	anchors        []dns.RR
+	spfFallback    bool
+	servedZones    []string
+	search         []string
+	allowedClients []net.IPNet
+	router         func(qname, qtype string) (servers []string, recurse bool)
+	forwarders     []string
+	nsRefresh      float64
+	refreshing     sync.Map
+	ndots          int
+	maxDepth       int
+	maxNameservers int
+	ednsSize       uint16
+	minPort        uint16
+	tcpRetry       bool
+	maxPort        uint16
+	dialer         *net.Dialer
+	tlsConfig      *tls.Config
+	// udp and tcp are the clients shared by the queries, they are replaced when the settings they are built from change
+	udp       *dns.Client
+	tcp       *dns.Client
+	sweepStop chan struct{}
+	metrics   *metrics
+	flight    singleflight.Group
+	m         sync.RWMutex
+	// rnd shuffles the nameservers and picks source ports, it is not safe for concurrent use and guarded by rndm
+	rnd  *rand.Rand
+	rndm sync.Mutex
 }
 
 // New creates a new resolver
 func New() *Resolver {
-	return &Resolver{
-		timeout: Timeout,
-		cache:   newCache(),
-		debug:   false,
+	// the embedded trust anchors are known to be valid
+	anchors, _ := parseTrustAnchors(strings.NewReader(rootAnchors))
+	r := &Resolver{
+		timeout:        Timeout,
+		logger:         stdLogger{},
+		cache:          newCache(),
+		shuffle:        true,
+		port:           "53",
+		ndots:          1,
+		maxDepth:       MaxDepth,
+		maxNameservers: MaxNameservers,
+		ednsSize:       EDNSBufferSize,
+		metrics:        newMetrics(),
+		anchors:        anchors,
+		rnd:            rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	r.resetClients()
+	return r
+}
+
+// NewWithRoot creates a new resolver starting from the root hints in zone file format, instead of the embedded
+// root hints of the internet. This allows resolving with alternate or internal roots. ErrNoRootHints is returned
+// if the hints have no nameserver of the root zone together with its address
+func NewWithRoot(hints io.Reader) (*Resolver, error) {
+	rrs, err := parseRootHints(hints)
+	if err != nil {
+		return nil, err
+	}
+	r := New()
+	r.cache = newCacheWithRoot(rrs)
+	return r, nil
+}
+
+// NewForwarding creates a new resolver that forwards all queries to the upstream recursive resolvers, see SetForwarders
+func NewForwarding(upstreams ...string) *Resolver {
+	r := New()
+	r.SetForwarders(upstreams)
+	return r
+}
+
+// AddRootHint adds a root server to the root hints of the resolver, together with its IPv4 or IPv6 address
+func (r *Resolver) AddRootHint(ns string, ip net.IP) error {
+	if ip == nil {
+		return fmt.Errorf("invalid address for root hint %s", ns)
 	}
+	if _, ok := dns.IsDomainName(ns); !ok {
+		return fmt.Errorf("invalid root hint %s", ns)
+	}
+	ns = toLowerFQDN(ns)
+	// root hints are valid for as long as those of the embedded hints
+	hdr := dns.RR_Header{Name: ns, Ttl: 3600000, Class: dns.ClassINET, Rrtype: dns.TypeA}
+	var addr dns.RR = &dns.A{Hdr: hdr, A: ip.To4()}
+	if ip.To4() == nil {
+		hdr.Rrtype = dns.TypeAAAA
+		addr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+	}
+	r.cache.addHint(&dns.NS{Hdr: dns.RR_Header{Name: ".", Ttl: 3600000, Class: dns.ClassINET, Rrtype: dns.TypeNS}, Ns: ns})
+	r.cache.addHint(addr)
+	return nil
+}
+
+// ClearCache removes all cached records and negative answers, only the root hints remain
+func (r *Resolver) ClearCache() {
+	r.cache.clear()
+}
+
+// FlushName removes all cached records and negative answers of a name, of every type
+func (r *Resolver) FlushName(qname string) {
+	r.cache.flush(qname)
 }
 
 // Debug enables or disables debug logging of a query
 func (r *Resolver) Debug(enable bool) {
+	r.debug.Store(enable)
+}
+
+// debugging returns true if debug logging is enabled, it is safe to call while Debug is toggled
+func (r *Resolver) debugging() bool {
+	return r.debug.Load()
+}
+
+// SetLogger sets where the debug logging is written to, which is the log package by default. A nil logger restores the default
+func (r *Resolver) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = stdLogger{}
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.logger = logger
+}
+
+// logf writes a debug message to the logger, callers check debugging first
+func (r *Resolver) logf(format string, args ...interface{}) {
+	r.m.RLock()
+	logger := r.logger
+	r.m.RUnlock()
+	logger.Printf(format, args...)
+}
+
+// SetRandSource sets the source of the random numbers that shuffle the nameservers and pick source ports,
+// a source with a fixed seed makes the order reproducible. A nil source restores a source seeded with the current time
+func (r *Resolver) SetRandSource(src rand.Source) {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	r.rndm.Lock()
+	defer r.rndm.Unlock()
+	r.rnd = rand.New(src)
+}
+
+// intn returns a random number in [0,n) from the source of the resolver
+func (r *Resolver) intn(n int) int {
+	r.rndm.Lock()
+	defer r.rndm.Unlock()
+	return r.rnd.Intn(n)
+}
+
+// SetShuffleNameservers enables or disables shuffling of the nameservers before querying them,
+// disabling it always queries the nameservers in the order they were returned
+func (r *Resolver) SetShuffleNameservers(enable bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.shuffle = enable
+}
+
+// SetMaxGoroutinesPerResolve limits the amount of goroutines a single resolution may run at the same time,
+// when the limit is reached nameservers are queried one at a time. A value of 0 or less disables the limit
+func (r *Resolver) SetMaxGoroutinesPerResolve(n int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.maxGoroutines = n
+}
+
+// SetCacheAuthoritativeOnly enables or disables caching only answers that have the authoritative (AA) flag set,
+// referrals and glue are always cached
+func (r *Resolver) SetCacheAuthoritativeOnly(enable bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.authOnly = enable
+}
+
+// SetStrictDelegation enables or disables strict delegation, where nameservers are only selected from the
+// delegation of the parent zone, and the NS records a zone publishes itself are never used. The TTL of the delegation
+// then decides how long the nameservers are cached, by default the NS records of the zone itself replace the delegation
+func (r *Resolver) SetStrictDelegation(enable bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.strict = enable
+}
+
+// SetQNameMinimization enables or disables QNAME minimization (RFC 7816), enabled by default. Nameservers above the
+// zone of a name are only asked for the NS records of the next label down, instead of the full name. Disabling it
+// sends the full name to the closest nameservers known, and follows their referrals, for servers that answer the
+// minimized queries wrongly
+func (r *Resolver) SetQNameMinimization(enable bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.noMinimize = !enable
+}
+
+// minimize returns true if QNAME minimization is enabled
+func (r *Resolver) minimize() bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return !r.noMinimize
+}
+
+// EnableDNSSEC enables DNSSEC validation. All queries ask for the signatures, and the answer of a resolution is
+// validated along the chain of trust from a trust anchor: answers signed by secure zones get the AD flag, answers
+// that fail validation return a *DNSSECError matching ErrDNSSECBogus. Answers of zones the chain of trust does not
+// reach, such as a zone its parent proves has no DS record, are returned without the AD flag. NXDOMAIN and NODATA
+// answers of secure zones need a NSEC or NSEC3 proof. The trust anchors are those of the root zone of the internet,
+// unless set with SetTrustAnchor. Records cached before are not signed, so it is best enabled before resolving
+func (r *Resolver) EnableDNSSEC() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.dnssec = true
+}
+
+// SetTrustAnchor sets the trust anchors DNSSEC validation starts from, replacing those of the root zone. The anchors
+// are DS or DNSKEY records in zone file format, such as the DS records of the root key signing keys published by
+// IANA, or those of an internal zone. ErrNoTrustAnchor is returned if there are none
+func (r *Resolver) SetTrustAnchor(anchors io.Reader) error {
+	rrs, err := parseTrustAnchors(anchors)
+	if err != nil {
+		return err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.anchors = rrs
+	return nil
+}
+
+// trustAnchors returns the trust anchors DNSSEC validation starts from
+func (r *Resolver) trustAnchors() []dns.RR {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.anchors
+}
+
+// SetSPFTypeFallback enables or disables looking up the deprecated SPF record type (99) in LookupSPF,
+// when a domain publishes no v=spf1 TXT record
+func (r *Resolver) SetSPFTypeFallback(enable bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.spfFallback = enable
+}
+
+// SetServedZones limits resolving to names within the given zones, other names are refused with ErrRefused.
+// An empty list serves all names
+func (r *Resolver) SetServedZones(zones []string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.servedZones = nil
+	for _, zone := range zones {
+		r.servedZones = append(r.servedZones, toLowerFQDN(zone))
+	}
+}
+
+// serves returns true if the name is within one of the served zones
+func (r *Resolver) serves(qname string) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if len(r.servedZones) == 0 {
+		return true
+	}
+	for _, zone := range r.servedZones {
+		if dns.IsSubDomain(zone, qname) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetStaggerDelay sets the delay between starting queries to the next nameserver, the next nameserver is
+// only queried if the previous ones did not answer within the delay. A delay of 0 queries all nameservers at once
+func (r *Resolver) SetStaggerDelay(d time.Duration) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.stagger = d
+}
+
+// SetConcurrency enables or disables querying concurrently, which is enabled by default. Without concurrency the
+// nameservers are queried one at a time and nothing is done in the background, so the queries and debug logging
+// follow each other in a fixed order
+func (r *Resolver) SetConcurrency(enable bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.sequential = !enable
+}
+
+// concurrent returns true if queries can be done concurrently
+func (r *Resolver) concurrent() bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return !r.sequential
+}
+
+// SetTimeout sets the time a resolution is allowed to take, which is also the timeout of a single query.
+// A duration of 0 or less restores the default Timeout
+func (r *Resolver) SetTimeout(d time.Duration) {
+	if d <= 0 {
+		d = Timeout
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.timeout = d
+	r.resetClients()
+}
+
+// queryTimeout returns the time a resolution is allowed to take
+func (r *Resolver) queryTimeout() time.Duration {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.timeout
+}
+
+// SetMaxDepth sets the max recursive depth to query, which defaults to MaxDepth. Values below 1 are raised to 1
+func (r *Resolver) SetMaxDepth(depth int) {
+	if depth < 1 {
+		depth = 1
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.maxDepth = depth
+}
+
+// SetMaxNameservers sets the max nameservers to query simultaneously for a query, which defaults to MaxNameservers.
+// Values below 1 are raised to 1
+func (r *Resolver) SetMaxNameservers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.maxNameservers = n
+}
+
+// SetEDNSBufferSize sets the UDP payload size advertised to nameservers, which defaults to EDNSBufferSize.
+// A size of 0 restores the default, sizes below the DNS minimum of 512 are raised to 512
+func (r *Resolver) SetEDNSBufferSize(size uint16) {
+	if size == 0 {
+		size = EDNSBufferSize
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.ednsSize = size
+}
+
+// SetTCPRetry enables or disables asking a nameserver again over TCP when it did not answer a UDP query or answered
+// with SERVFAIL, before another nameserver is tried. This helps when UDP is tampered with on the way, but doubles
+// the time spent on servers that are really failing. Truncated responses are always retried over TCP
+func (r *Resolver) SetTCPRetry(enable bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.tcpRetry = enable
+}
+
+// SetPort sets the port nameservers are queried on, 53 by default. A port of 0 restores the default
+func (r *Resolver) SetPort(port uint16) {
+	if port == 0 {
+		port = 53
+	}
 	r.m.Lock()
 	defer r.m.Unlock()
-	r.debug = enable
+	r.port = strconv.Itoa(int(port))
 }
 
-// Resolve resoves a record by name and type, and returns the message of the answer
+// upstreamPort returns the port nameservers are queried on
+func (r *Resolver) upstreamPort() string {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if r.tlsConfig != nil && r.port == "53" {
+		return "853"
+	}
+	return r.port
+}
+
+// SetTLS sends all queries over DNS-over-TLS (RFC 7858) with the TLS config, to port 853 unless set otherwise with
+// SetPort. The certificate of a nameserver is verified against its name, or its address if it is queried by address,
+// such as a forwarder. Set ServerName in the config to verify all certificates against the same name. nil sends the
+// queries over UDP again
+func (r *Resolver) SetTLS(config *tls.Config) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.tlsConfig = nil
+	if config != nil {
+		r.tlsConfig = config.Clone()
+	}
+}
+
+// tlsClient returns a client sending a query to the nameserver over TLS, nil if queries are not sent over TLS
+func (r *Resolver) tlsClient(ns string) *dns.Client {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if r.tlsConfig == nil {
+		return nil
+	}
+	config := r.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = strings.TrimSuffix(ns, ".")
+	}
+	return &dns.Client{Net: "tcp-tls", Timeout: r.timeout, Dialer: r.newDialer("tcp", 0), TLSConfig: config}
+}
+
+// SetSourcePortRange sets the range of source ports queries are sent from, each UDP query uses a random port of the range.
+// By default the operating system picks a random port. A max of 0 restores the default.
+// The UDP socket is connected to the nameserver, so only responses from the queried address and port are accepted
+func (r *Resolver) SetSourcePortRange(min, max uint16) {
+	if min > max {
+		min, max = max, min
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.minPort, r.maxPort = min, max
+}
+
+// SetDialer sets the dialer queries connect to nameservers with, for instance to send them from the address of an
+// interface with LocalAddr, or to control the socket with Control. The port of LocalAddr is not used, and the timeout
+// of the resolver applies if the dialer has none. nil restores the default
+func (r *Resolver) SetDialer(dialer *net.Dialer) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.dialer = nil
+	if dialer != nil {
+		d := *dialer
+		r.dialer = &d
+	}
+	r.resetClients()
+}
+
+// resetClients builds the clients shared by the queries from the settings, the lock of r.m must be held.
+// The clients time out after the timeout of the resolver, the deadline of the context can end an exchange sooner.
+// Without a timeout the client would limit each exchange to 2 seconds
+func (r *Resolver) resetClients() {
+	r.udp = &dns.Client{Timeout: r.timeout, Dialer: r.newDialer("udp", 0)}
+	r.tcp = &dns.Client{Net: "tcp", Timeout: r.timeout, Dialer: r.newDialer("tcp", 0)}
+}
+
+// client returns the client for a UDP query, which is shared and must not be changed. If the source port range is set,
+// each query gets its own client sending it from a random port of the range
+func (r *Resolver) client() *dns.Client {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if r.maxPort == 0 && r.udp != nil {
+		return r.udp
+	}
+	port := 0
+	if r.maxPort != 0 {
+		port = int(r.minPort) + r.intn(int(r.maxPort)-int(r.minPort)+1)
+	}
+	// client must finish within remaining timeout
+	return &dns.Client{Timeout: r.timeout, Dialer: r.newDialer("udp", port)}
+}
+
+// tcpClient returns the client for a TCP query, which is shared and must not be changed
+func (r *Resolver) tcpClient() *dns.Client {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if r.tcp != nil {
+		return r.tcp
+	}
+	return &dns.Client{Net: "tcp", Timeout: r.timeout, Dialer: r.newDialer("tcp", 0)}
+}
+
+// newDialer returns a dialer for the network sending from the source port, or nil if the default dialer of the client
+// does. The read lock of r.m must be held
+func (r *Resolver) newDialer(network string, port int) *net.Dialer {
+	if r.dialer == nil && port == 0 {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: r.timeout}
+	var ip net.IP
+	if r.dialer != nil {
+		*dialer = *r.dialer
+		if dialer.Timeout == 0 {
+			dialer.Timeout = r.timeout
+		}
+		ip = localIP(dialer.LocalAddr)
+	}
+	// the local address has to be of the type of the network
+	switch {
+	case ip == nil && port == 0:
+		dialer.LocalAddr = nil
+	case network == "tcp":
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	default:
+		dialer.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+	}
+	return dialer
+}
+
+// localIP returns the IP of a local address, nil if it has none
+func localIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// SetMaxCachePerZone limits the records cached from the nameservers of a single zone, so one zone cannot fill the cache.
+// A zone at the limit makes room by removing its own records that expire first. A value of 0 or less disables the limit
+func (r *Resolver) SetMaxCachePerZone(max int) {
+	r.cache.setZoneLimit(max)
+}
+
+// SetMinTTL sets the shortest time records are cached, lower TTLs are raised to it. It also applies to cached NXDOMAIN
+// and NODATA answers, but not to records with a TTL of 0, see SetZeroTTL
+func (r *Resolver) SetMinTTL(d time.Duration) {
+	r.cache.setMinTTL(uint32(d / time.Second))
+}
+
+// SetMaxTTL sets the longest time records are cached, higher TTLs are lowered to it. A duration of 0 leaves TTLs
+// unbounded. It also applies to cached NXDOMAIN and NODATA answers
+func (r *Resolver) SetMaxTTL(d time.Duration) {
+	r.cache.setMaxTTL(uint32(d / time.Second))
+}
+
+// SetZeroTTL sets how long records with a TTL of 0 are cached. By default they are not cached, as a TTL of 0 asks
+// for the record to be used only once. Caching them briefly saves queries for names that always send a TTL of 0
+func (r *Resolver) SetZeroTTL(d time.Duration) {
+	r.cache.setZeroTTL(uint32(d / time.Second))
+}
+
+// SetCacheSweep starts removing expired records from the cache every interval in the background, replacing an earlier
+// sweep. An interval of 0 or less stops sweeping, Close stops it as well
+func (r *Resolver) SetCacheSweep(interval time.Duration) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.sweepStop != nil {
+		close(r.sweepStop)
+		r.sweepStop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	r.sweepStop = stop
+	cache := r.cache
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cache.sweep()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the background work of the resolver
+func (r *Resolver) Close() error {
+	r.SetCacheSweep(0)
+	return nil
+}
+
+// CacheInsertStats returns how many records were added to the cache as new, and how many refreshed a record that was
+// already cached. Many refreshes mean the nameservers are asked for records that are already known
+func (r *Resolver) CacheInsertStats() (added, refreshed uint64) {
+	return r.cache.insertStats()
+}
+
+// SetMaxRecords limits the total amount of records in a returned message, records that do not fit are
+// dropped and the message is marked as truncated. A value of 0 or less disables the limit
+func (r *Resolver) SetMaxRecords(max int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.maxRecords = max
+}
+
+// SetRouter sets a function that decides per query where it is sent. It returns the servers (IP addresses) to send
+// the query to, which are asked to recurse, or recurse as true to resolve the query normally. Returning no servers and
+// recurse as false refuses the query
+func (r *Resolver) SetRouter(router func(qname, qtype string) (servers []string, recurse bool)) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.router = router
+}
+
+// SetForwarders sets the upstream recursive resolvers (IP addresses) all queries are sent to, asking them to recurse,
+// instead of resolving from the root. The answers are cached like any other, and the query goes to the next upstream if
+// one fails. A router set with SetRouter takes precedence. No upstreams resolve from the root again
+func (r *Resolver) SetForwarders(upstreams []string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.forwarders = append([]string{}, upstreams...)
+}
+
+// route returns the servers the router or forwarders selected for a query, recurse is true if the query should be resolved normally
+func (r *Resolver) route(qname, qtype string) (servers []string, recurse bool) {
+	r.m.RLock()
+	router := r.router
+	forwarders := r.forwarders
+	r.m.RUnlock()
+	if router != nil {
+		return router(qname, qtype)
+	}
+	if len(forwarders) > 0 {
+		return forwarders, false
+	}
+	return nil, true
+}
+
+// SetNSRefresh enables refreshing cached NS records in the background, once they are used with less than
+// fraction of their TTL left. This keeps the delegations that are in use from expiring. A fraction of 0 disables it
+func (r *Resolver) SetNSRefresh(fraction float64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.nsRefresh = fraction
+}
+
+// refreshNS asks the nameservers of a zone for its NS records in the background, if the cached NS records are about to expire
+func (r *Resolver) refreshNS(zone string, ns []string) {
+	r.m.RLock()
+	fraction := r.nsRefresh
+	r.m.RUnlock()
+	if fraction <= 0 || len(ns) == 0 || !r.cache.expiring(zone, "NS", fraction) {
+		return
+	}
+	if _, busy := r.refreshing.LoadOrStore(zone, true); busy {
+		return
+	}
+	refresh := func() {
+		defer r.refreshing.Delete(zone)
+		ctx, cancel := context.WithTimeout(context.Background(), r.queryTimeout())
+		defer cancel()
+		// the refresh queries with the settings of a resolution, and is validated like one
+		qs := r.newResolveState(ResolveOptions{})
+		rmsg, err := r.queryMultiple(ctx, ns, zone, "NS", qs, 0)
+		if err == nil && qs.validate {
+			err = r.validate(ctx, zone, "NS", rmsg, 0, qs)
+		}
+		if err != nil {
+			if r.debugging() {
+				r.logf("REFRESH NS %s failed: %s", zone, err)
+			}
+			return
+		}
+		scrubBailiwick(rmsg, zone)
+		r.cacheResponse(zone, "NS", zone, rmsg)
+	}
+	if !r.concurrent() {
+		refresh()
+		return
+	}
+	go refresh()
+}
+
+// SetSearchDomains sets the domains that are appended to names that are not fully qualified (do not end with a dot)
+func (r *Resolver) SetSearchDomains(domains []string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.search = nil
+	for _, domain := range domains {
+		r.search = append(r.search, toLowerFQDN(domain))
+	}
+}
+
+// SetNdots sets the amount of dots a name needs to be tried as is before the search domains, the default is 1
+func (r *Resolver) SetNdots(ndots int) {
+	if ndots < 0 {
+		ndots = 0
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.ndots = ndots
+}
+
+// searchNames returns the names to try for qname in order, using the search domains like resolv.conf does
+func (r *Resolver) searchNames(qname string) []string {
+	if strings.HasSuffix(qname, ".") {
+		return []string{toLowerFQDN(qname)}
+	}
+	r.m.RLock()
+	search := r.search
+	ndots := r.ndots
+	r.m.RUnlock()
+
+	names := []string{}
+	for _, domain := range search {
+		names = append(names, toLowerFQDN(qname+"."+domain))
+	}
+	if strings.Count(qname, ".") >= ndots {
+		return append([]string{toLowerFQDN(qname)}, names...)
+	}
+	return append(names, toLowerFQDN(qname))
+}
+
+// Resolve resoves a record by name and type, and returns the message of the answer.
+// The TTLs in the answer are the time left in the cache, the same a later resolution from the cache would return.
+// A name that does not exist returns the message together with a *DNSError matching ErrNXDomain
 func (r *Resolver) Resolve(qname, qtype string) (*dns.Msg, error) {
-	if !strings.HasSuffix(qname, ".") {
-		qname += "."
+	return r.ResolveContext(context.Background(), qname, qtype)
+}
+
+// ResolveContext resolves a record by name and type like Resolve within the context, cancelling the context aborts
+// the queries in flight. The timeout of the resolver still applies
+func (r *Resolver) ResolveContext(ctx context.Context, qname, qtype string) (*dns.Msg, error) {
+	result, err := r.resolveSearch(ctx, qname, qtype, ResolveOptions{})
+	if result == nil {
+		return nil, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	return result.Msg, err
+}
+
+// ResolveBestEffort resolves a record by name and type like Resolve, but stops at the deadline and returns what was
+// resolved until then, such as the first part of a cname chain. incomplete is true if the deadline stopped the resolution
+func (r *Resolver) ResolveBestEffort(ctx context.Context, qname, qtype string, deadline time.Time) (msg *dns.Msg, incomplete bool, err error) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
 	defer cancel()
-	return r.resolveWithContext(ctx, toLowerFQDN(qname), qtype, 0)
+	msg, err = r.resolveWithContext(ctx, toLowerFQDN(qname), qtype, 0, r.newResolveState(ResolveOptions{}))
+	if ctx.Err() == nil || (err == nil && len(msg.Answer) > 0) {
+		// the resolution finished before the deadline
+		return msg, false, err
+	}
+	if msg == nil {
+		msg = &dns.Msg{}
+		msg.SetQuestion(toLowerFQDN(qname), dns.StringToType[qtype])
+	}
+	return msg, true, nil
+}
+
+// newResolveState creates the state for a new resolution with the options
+func (r *Resolver) newResolveState(opts ResolveOptions) *queryState {
+	r.m.RLock()
+	qs := newQueryState(r.maxGoroutines)
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = r.maxDepth
+	}
+	if opts.EDNSBufferSize == 0 {
+		opts.EDNSBufferSize = r.ednsSize
+	}
+	qs.validate = r.dnssec
+	r.m.RUnlock()
+	qs.opts = opts
+	return qs
 }
 
 // resolveWithContext resolves a query, and returns all results, with a context handler
-func (r *Resolver) resolveWithContext(ctx context.Context, qname, qtype string, depth int) (*dns.Msg, error) {
-	qs := make(map[string]int)
-	if r.debug {
-		log.Printf("INITIAL %d query - %s %s", depth, qname, qtype)
+func (r *Resolver) resolveWithContext(ctx context.Context, qname, qtype string, depth int, qs *queryState) (*dns.Msg, error) {
+	// a context that is already done would only fail the resolution after doing work for it
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !r.serves(qname) {
+		return nil, ErrRefused
+	}
+	opts := qs.opts
+	if r.debugging() {
+		r.logf("INITIAL %d query - %s %s", depth, qname, qtype)
 	}
 	//qs[qname+qtype] = true
 	msg, err := r.queryWithCache(ctx, qname, qtype, depth, qs)
 	if err != nil {
 		return nil, err
 	}
-	for len(msg.Answer) == 0 && depth < MaxDepth && err != ErrQueryLoop {
+	// remember when each part of the answer was retrieved, so all TTLs can be normalized to the same moment
+	answers := []rrSet{{rrs: msg.Answer, at: time.Now()}}
+	extras := []rrSet{{rrs: msg.Extra, at: time.Now()}}
+	// an empty answer is retried, unless it is a NODATA or NXDOMAIN which will not change by asking again
+	for len(msg.Answer) == 0 && !IsNoData(msg) && !IsNXDomain(msg) && depth < opts.maxDepth() {
 		depth++
 		msg2, err2 := r.queryWithCache(ctx, qname, qtype, depth, qs)
+		if err2 == ErrQueryLoop {
+			break
+		}
 		if err2 == nil {
 			msg.Answer = append(msg.Answer, msg2.Answer...)
+			msg.Ns = msg2.Ns
+			msg.Rcode = msg2.Rcode
+			answers = append(answers, rrSet{rrs: msg2.Answer, at: time.Now()})
 			//return nil, err
 		}
 	}
 	//log.Printf("FINISHED %d query - %s %s\nmsg: %v\n", depth, qname, qtype, msg)
-	for qtype == "A" && len(findA(msg.Answer)) == 0 && depth < MaxDepth {
-		cname := findCNAME(msg.Answer)
-		if len(cname) == 0 {
+	for qtype == "A" || qtype == "AAAA" {
+		// only follow the cname chain of the queried name, other cnames in the answer are unrelated
+		target := cnameTarget(msg.Answer, qname)
+		if target == qname || hasRR(msg.Answer, target, dns.StringToType[qtype]) || opts.NoCNAMEFollow {
 			break
 		}
-		depth++
-		// follow the latest cname added
-		msg2, err := r.queryWithCache(ctx, cname[len(cname)-1], "A", depth, qs)
-		if err == nil {
-			msg.Answer = append(msg.Answer, msg2.Answer...)
+		if !qs.followCNAME() {
+			err = ErrIncompleteCNAME
+			break
+		}
+		msg2, err2 := r.queryWithCache(ctx, target, qtype, depth, qs)
+		if err2 == nil && len(msg2.Answer) == 0 && (IsNoData(msg2) || IsNXDomain(msg2)) {
+			// the target resolved to no records, which is the answer for the whole chain (RFC 6604)
+			msg.Ns = msg2.Ns
+			msg.Rcode = msg2.Rcode
+			break
+		}
+		if err2 != nil || len(msg2.Answer) == 0 {
+			// the cname target did not resolve, retrying will not change that
+			err = ErrIncompleteCNAME
+			break
+		}
+		msg.Answer = append(msg.Answer, msg2.Answer...)
+		answers = append(answers, rrSet{rrs: msg2.Answer, at: time.Now()})
+	}
+	// a name that does not exist is returned as an error together with the message, so it can be told apart from a failure
+	if err == nil && IsNXDomain(msg) {
+		err = &DNSError{Name: qname, Rcode: msg.Rcode}
+	}
+	if qs.validate && (err == nil || IsNXDomain(msg)) {
+		if verr := r.validate(ctx, qname, qtype, msg, depth, qs); verr != nil {
+			return nil, verr
 		}
 	}
-	if qtype == "NS" && len(findA(msg.Extra)) == 0 {
+	if qtype == "NS" && len(findA(msg.Extra)) == 0 && opts.wants(SectionAdditional) {
 		ns := findNS(msg.Answer)
 		if len(ns) > 0 {
 			msg2, err := r.queryWithCache(ctx, ns[0], "A", depth, qs)
 			if err == nil {
 				msg.Extra = append(msg.Extra, msg2.Extra...)
+				extras = append(extras, rrSet{rrs: msg2.Extra, at: time.Now()})
 			}
 		}
 	}
+	now := time.Now()
+	normalizeTTL(now, answers...)
+	normalizeTTL(now, extras...)
+	// the parts of a CNAME chain were cached at different times, the answer is only valid until the first expires
+	lowestTTL(msg.Answer)
+	if !opts.DNSSEC && qtype != "RRSIG" {
+		// signatures can be in the cache from an earlier resolution, they are only returned when asked for
+		msg.Answer = withoutRR(msg.Answer, dns.TypeRRSIG)
+	}
+	if !opts.wants(SectionAnswer) {
+		msg.Answer = nil
+	}
+	if !opts.wants(SectionAuthority) {
+		msg.Ns = nil
+	}
+	if !opts.wants(SectionAdditional) {
+		msg.Extra = nil
+	}
+
+	r.m.RLock()
+	maxRecords := r.maxRecords
+	r.m.RUnlock()
+	if truncateMsg(msg, maxRecords) && r.debugging() {
+		r.logf("TRUNCATED %d query - %s %s to %d records", depth, qname, qtype, maxRecords)
+	}
 	return msg, err
 }
 
-var qloc sync.Mutex
+// truncateMsg limits the total amount of records in a message to max, keeping the answer section first,
+// followed by the authority and additional sections. It returns true and sets the truncated flag if records were dropped
+func truncateMsg(msg *dns.Msg, max int) bool {
+	if max <= 0 || len(msg.Answer)+len(msg.Ns)+len(msg.Extra) <= max {
+		return false
+	}
+	left := max
+	keep := func(rrs []dns.RR) []dns.RR {
+		if len(rrs) > left {
+			rrs = rrs[:left]
+		}
+		left -= len(rrs)
+		return rrs
+	}
+	msg.Answer = keep(msg.Answer)
+	msg.Ns = keep(msg.Ns)
+	msg.Extra = keep(msg.Extra)
+	msg.Truncated = true
+	return true
+}
+
+// rrSet is a group of records and the moment they were retrieved
+type rrSet struct {
+	rrs []dns.RR
+	at  time.Time
+}
+
+// normalizeTTL lowers the TTL of all records by the time passed since they were retrieved,
+// so records gathered at different steps of a query present their TTL relative to now
+func normalizeTTL(now time.Time, sets ...rrSet) {
+	for _, set := range sets {
+		age := uint32(now.Sub(set.at) / time.Second)
+		for _, rr := range set.rrs {
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+}
+
+// lowestTTL sets the TTL of all records to the lowest TTL among them
+func lowestTTL(rrs []dns.RR) {
+	ttl := MinTTL(&dns.Msg{Answer: rrs})
+	for _, rr := range rrs {
+		rr.Header().Ttl = ttl
+	}
+}
+
+// queryState is the state shared by all queries done for a single resolution, the queries run in parallel so the
+// state is only changed through its methods
+type queryState struct {
+	// m guards the fields below, except sem, opts and validate which do not change
+	m sync.Mutex
+	// counts holds how often a name and type were queried, to detect loops
+	counts map[string]int
+	// nsLookups holds the nameserver names the address was resolved of
+	nsLookups map[string]bool
+	// cnames counts the cnames followed, separate from the depth as a cname chain does not recurse the delegation
+	cnames int
+	// sem limits the goroutines started for the resolution, nil if unlimited
+	sem chan struct{}
+	// opts are the options of the resolution
+	opts ResolveOptions
+	// nsids holds the NSID of the server that answered a name and type, if the options ask for it
+	nsids map[string]string
+	// flights holds the names and types this resolution is querying upstream, shared with concurrent resolutions
+	flights map[string]bool
+	// validate sets the DO bit on all queries, and validates the answer with DNSSEC
+	validate bool
+}
+
+// newQueryState creates the state for a new resolution, allowing up to maxGoroutines goroutines (0 is unlimited)
+func newQueryState(maxGoroutines int) *queryState {
+	qs := &queryState{
+		counts: make(map[string]int),
+	}
+	if maxGoroutines > 0 {
+		qs.sem = make(chan struct{}, maxGoroutines)
+	}
+	return qs
+}
+
+// count counts a query of a name and type, it returns false if the resolution queried it too often, which is a loop
+func (qs *queryState) count(qname, qtype string) bool {
+	qs.m.Lock()
+	defer qs.m.Unlock()
+	qs.counts[qname+"_"+qtype]++
+	return qs.counts[qname+"_"+qtype] <= 4
+}
+
+// enterFlight marks a name and type as queried upstream by this resolution, it returns false if it already is
+func (qs *queryState) enterFlight(key string) bool {
+	qs.m.Lock()
+	defer qs.m.Unlock()
+	if qs.flights[key] {
+		return false
+	}
+	if qs.flights == nil {
+		qs.flights = make(map[string]bool)
+	}
+	qs.flights[key] = true
+	return true
+}
+
+// leaveFlight marks a name and type as no longer queried upstream by this resolution
+func (qs *queryState) leaveFlight(key string) {
+	qs.m.Lock()
+	defer qs.m.Unlock()
+	delete(qs.flights, key)
+}
+
+// flightKey returns the options of the resolution that change the queries sent upstream, resolutions only share
+// the queries of another resolution with the same options
+func (qs *queryState) flightKey() string {
+	o := qs.opts
+	return fmt.Sprintf("%v|%v|%t|%t|%d|%d|%d|%t", o.BlockedNameservers, o.Forwarders, o.DNSSEC, qs.validate, o.EDNSBufferSize, o.MaxDepth, o.Sections, o.NoCNAMEFollow)
+}
+
+// setNSID remembers the NSID of the server that answered a name and type
+func (qs *queryState) setNSID(qname, qtype, nsid string) {
+	qs.m.Lock()
+	defer qs.m.Unlock()
+	if qs.nsids == nil {
+		qs.nsids = make(map[string]string)
+	}
+	qs.nsids[qname+"_"+qtype] = nsid
+}
+
+// nsid returns the NSID of the server that answered a name and type, empty if unknown
+func (qs *queryState) nsid(qname, qtype string) string {
+	qs.m.Lock()
+	defer qs.m.Unlock()
+	return qs.nsids[qname+"_"+qtype]
+}
+
+// lookupNS counts a nameserver name that needs its address resolved, it returns false if the resolution
+// already resolved MaxNSLookups other nameserver names, which stops zones sending us after endless nameserver names
+func (qs *queryState) lookupNS(name string) bool {
+	qs.m.Lock()
+	defer qs.m.Unlock()
+	if qs.nsLookups[name] {
+		return true
+	}
+	if len(qs.nsLookups) >= MaxNSLookups {
+		return false
+	}
+	if qs.nsLookups == nil {
+		qs.nsLookups = make(map[string]bool)
+	}
+	qs.nsLookups[name] = true
+	return true
+}
+
+// followCNAME counts a cname that is followed, it returns false if the resolution does not follow cnames or followed
+// the max depth of cnames
+func (qs *queryState) followCNAME() bool {
+	qs.m.Lock()
+	defer qs.m.Unlock()
+	if qs.opts.NoCNAMEFollow || qs.cnames >= qs.opts.maxDepth() {
+		return false
+	}
+	qs.cnames++
+	return true
+}
+
+// acquire reserves a goroutine for the resolution, it returns false if there are none left
+func (qs *queryState) acquire() bool {
+	if qs.sem == nil {
+		return true
+	}
+	select {
+	case qs.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release returns a goroutine reserved by acquire
+func (qs *queryState) release() {
+	if qs.sem != nil {
+		<-qs.sem
+	}
+}
 
 // queryWithCache
-func (r *Resolver) queryWithCache(ctx context.Context, qname, qtype string, depth int, qs map[string]int) (*dns.Msg, error) {
-	if r.debug {
-		log.Printf("\n----------- QUERY WITH CACHE depth:%d - [%s] [%s] ---------\n", depth, qname, qtype)
+func (r *Resolver) queryWithCache(ctx context.Context, qname, qtype string, depth int, qs *queryState) (*dns.Msg, error) {
+	if r.debugging() {
+		r.logf("\n----------- QUERY WITH CACHE depth:%d - [%s] [%s] ---------\n", depth, qname, qtype)
 	}
-	if depth > MaxDepth {
+	if depth > qs.opts.maxDepth() {
 		return nil, ErrMaxDepth
 	}
 	// find requested record in cache
-	msg := r.cache.get(qname, qtype)
-	if len(msg.Answer) != 0 {
-		if r.debug {
-			log.Printf("CACHED result depth:%d [%s] [%s] returns: \n%+v\n", depth, qname, qtype, msg)
+	// addresses from glue are used to reach nameservers, but are not an answer
+	msg := r.cache.lookup(qname, qtype, qs.opts.wants(SectionAdditional), qtype != "A" && qtype != "AAAA")
+	// cached nameservers whose glue expired are not an answer, their addresses have to come from the parent again
+	if len(msg.Answer) != 0 && (qtype != "NS" || !r.deadGlue(qname, findNS(msg.Answer))) {
+		if r.debugging() {
+			r.logf("CACHED result depth:%d [%s] [%s] returns: \n%+v\n", depth, qname, qtype, msg)
+		}
+		r.metrics.cacheHit()
+		if qtype == "NS" {
+			r.refreshNS(qname, findNS(msg.Answer))
 		}
 		return msg, nil
 	}
+	// the name was found to have no records of this type before
+	if nmsg, ok := r.cache.getNegative(qname, qtype); ok {
+		r.metrics.cacheHit()
+		return nmsg, nil
+	}
+	r.metrics.cacheMiss()
+
+	if !qs.count(qname, qtype) {
+		r.metrics.queryLoop()
+		return nil, ErrQueryLoop
+	}
 
-	qloc.Lock()
-	if _, ok := qs[qname+"_"+qtype]; ok {
-		qs[qname+"_"+qtype]++
-		if qs[qname+"_"+qtype] > 4 {
-			qloc.Unlock()
-			return nil, ErrQueryLoop
+	// concurrent resolutions of the same name and type with the same options share the upstream queries. A resolution
+	// that needs a name and type while it is querying it already, such as the address of a nameserver within its own
+	// zone, queries it itself. So does a resolution asking for the NSID, which is kept in the state of the resolution
+	key := qname + "_" + qtype + "_" + qs.flightKey()
+	if qs.opts.NSID || !qs.enterFlight(key) {
+		return r.queryUpstream(ctx, qname, qtype, depth, qs)
+	}
+	defer qs.leaveFlight(key)
+	var leader int32
+	flight := r.flight.DoChan(key, func() (interface{}, error) {
+		atomic.StoreInt32(&leader, 1)
+		msg, err := r.queryUpstream(ctx, qname, qtype, depth, qs)
+		// a read can time out at the deadline of the context just before the context reports it
+		if deadline, ok := ctx.Deadline(); err != nil && (ctx.Err() != nil || ok && !time.Now().Before(deadline)) {
+			err = &flightError{err: err}
 		}
-	} else {
-		qs[qname+"_"+qtype] = 1
+		return msg, err
+	})
+	var res singleflight.Result
+	select {
+	case res = <-flight:
+	case <-ctx.Done():
+		if atomic.LoadInt32(&leader) == 0 {
+			// the queries belong to another resolution, which may take longer than this one is allowed to
+			return nil, ctx.Err()
+		}
+		// the queries of this resolution stop with its context, and can still return a partial answer
+		res = <-flight
+	}
+	var ended *flightError
+	if errors.As(res.Err, &ended) {
+		if atomic.LoadInt32(&leader) == 0 && ctx.Err() == nil {
+			// the resolution that did the queries was cancelled or ran out of time, this one did not
+			return r.queryUpstream(ctx, qname, qtype, depth, qs)
+		}
+		res.Err = ended.err
+	}
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	msg = res.Val.(*dns.Msg)
+	if res.Shared {
+		// every resolution gets its own copy, as the message is changed while the answer is assembled
+		msg = msg.Copy()
+	}
+	return msg, nil
+}
+
+// flightError is the error of shared queries that failed after the context of the resolution doing them ended, such
+// as the timeout of a single query or the context error itself
+type flightError struct {
+	err error
+}
+
+// Error returns the error of the queries
+func (e *flightError) Error() string {
+	return e.err.Error()
+}
+
+// queryUpstream finds the nameservers of a name and queries them, or sends the query to the servers of the router
+func (r *Resolver) queryUpstream(ctx context.Context, qname, qtype string, depth int, qs *queryState) (*dns.Msg, error) {
+	// a router or the forwarders of the resolution can send the query to their own servers, instead of finding the nameservers by recursing
+	servers, recurse := r.route(qname, qtype)
+	if len(qs.opts.Forwarders) > 0 {
+		servers, recurse = qs.opts.Forwarders, false
+	}
+	if !recurse {
+		return r.queryRouted(ctx, servers, qname, qtype, qs, depth)
 	}
-	qloc.Unlock()
 	// if record is not in cache, find the NS for the record in cache
 	// find requested record in cache
 	//log.Printf("QUERY NS depth:%d - %s %s", depth, qname, qtype)
-	msg = r.cache.get(qname, "NS")
-	if len(msg.Answer) != 0 {
-		//log.Printf("CACHED NS result depth:%d", depth)
-	} else {
+	msg := r.cache.get(qname, "NS")
+	nsrrs := msg.Answer
+	switch {
+	case len(nsrrs) == 0:
 		//log.Printf("NONCACHED depth:%d - %s %s: %+v", depth, qname, qtype, msg)
+	case r.deadGlue(qname, findNS(nsrrs)):
+		// the nameservers are cached, but can only be reached through glue that expired, so they are found at the parent again
+		if r.debugging() {
+			r.logf("DEAD GLUE depth:%d - %s NS %v", depth, qname, findNS(nsrrs))
+		}
+		nsrrs = nil
+	default:
+		//log.Printf("CACHED NS result depth:%d", depth)
 	}
 
-	nsrrs := msg.Answer
+	// the full name goes to the closest nameservers known, their referrals lead to the nameservers of the name
+	follow := false
+	if len(nsrrs) == 0 {
+		closest := r.closestNS(qname)
+		if !r.minimize() || dns.CountLabel(qname)-dns.CountLabel(filterZone(closest)) > MaxMinimizeLabels {
+			nsrrs, follow = closest, true
+		}
+	}
 	if len(nsrrs) == 0 {
 		///log.Printf("QUERY NS records for query not found, check upstream depth:%d - %s %s", depth, qname, "NS")
 		// if record is not in cache, ask for the parent NS
@@ -173,7 +1287,8 @@ func (r *Resolver) queryWithCache(ctx context.Context, qname, qtype string, dept
 			nsrrs = msg.Ns
 		} else {
 			///log.Printf("QUERY NS records for query returned, OK in upstream depth:%d - %s %s", depth, qname, "NS")
-			nsrrs = msg.Answer
+			// some servers also list the NS records in the authority section, these are merged below
+			nsrrs = append(append([]dns.RR{}, msg.Answer...), filterRR(msg.Ns, dns.TypeNS)...)
 		}
 
 	}
@@ -181,11 +1296,13 @@ func (r *Resolver) queryWithCache(ctx context.Context, qname, qtype string, dept
 	//log.Printf("RESULT NS %d records for query: %s %s %+v", depth, qname, "NS", nsrrs)
 	// we should have NS records now to do the query
 
-	ns := findNS(nsrrs)
+	ns := uniqueNames(findNS(nsrrs))
 	if len(ns) == 0 {
 		//log.Printf("FINAL NS depth:%d error findDNS %s", depth, ErrNoNS)
 		return nil, ErrNoNS
 	}
+	// the zone the nameservers serve, they are not trusted for records outside of it
+	zone := filterZone(nsrrs)
 	///log.Printf("QUERY depth:%d returned the folling NS - \n%+v\n", depth, ns)
 
 	// if not in cache, find record on available NS's
@@ -195,81 +1312,270 @@ func (r *Resolver) queryWithCache(ctx context.Context, qname, qtype string, dept
 		///log.Printf("QUERY %d multiple failed: %s %s -> %s", depth, qname, qtype, err)
 		return nil, err
 	}
+	scrubBailiwick(rmsg, zone)
+	for follow && isReferral(rmsg, zone, qname) {
+		r.cache.addZoneMsg(rmsg, zone)
+		nsrrs = filterRR(rmsg.Ns, dns.TypeNS)
+		ns, zone = uniqueNames(findNS(nsrrs)), filterZone(nsrrs)
+		depth++
+		if depth > qs.opts.maxDepth() {
+			return nil, ErrMaxDepth
+		}
+		if r.debugging() {
+			r.logf("REFERRAL depth:%d - %s %s to %s %v", depth, qname, qtype, zone, ns)
+		}
+		rmsg, err = r.queryMultiple(ctx, ns, qname, qtype, qs, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		scrubBailiwick(rmsg, zone)
+	}
+	// as a last resort the answer is taken from the additional section, so the response is not retried as empty
+	if rrs := extraAnswer(rmsg, qname, dns.StringToType[qtype]); len(rrs) > 0 {
+		if r.debugging() {
+			r.logf("ANSWER IN EXTRA depth:%d - %s %s", depth, qname, qtype)
+		}
+		rmsg.Answer = rrs
+	}
 
 	///log.Printf("FINISHED %d query - %s %s\nmsg: %v\n", depth, qname, qtype, msg)
-	for qtype == "A" && len(findA(rmsg.Answer)) == 0 && depth < MaxDepth {
-		cname := findCNAME(rmsg.Answer)
-		if len(cname) == 0 {
+	for qtype == "A" || qtype == "AAAA" {
+		// only follow the cname chain of the queried name, other cnames in the answer are unrelated
+		target := cnameTarget(rmsg.Answer, qname)
+		if target == qname || hasRR(rmsg.Answer, target, dns.StringToType[qtype]) || !qs.followCNAME() {
 			break
 		}
-		depth++
-		// follow the latest cname added
-		msg2, err := r.queryWithCache(ctx, cname[len(cname)-1], "A", depth, qs)
-		if err == nil {
-			rmsg.Answer = append(rmsg.Answer, msg2.Answer...)
+		// the target is a new name to resolve, not a level deeper in the delegation
+		msg2, err := r.queryWithCache(ctx, target, qtype, depth, qs)
+		if err != nil || len(msg2.Answer) == 0 {
+			// the resolution tells a target without records apart from one that failed
+			break
 		}
+		rmsg.Answer = append(rmsg.Answer, msg2.Answer...)
 	}
 
 	//log.Printf("QUERY %d multiple ok!: %s %s -> %s", depth, qname, qtype, err)
 
-	// add record to cache
-	r.cache.addMsg(rmsg)
+	r.cacheResponse(qname, qtype, zone, rmsg)
 
 	//log.Printf("QUERY %d FINAL message: %s %s %+v", depth, qname, qtype, rmsg)
 
 	return rmsg, nil
 }
 
+// closestNS returns the cached nameservers of the closest zone above qname that can be reached
+func (r *Resolver) closestNS(qname string) []dns.RR {
+	for name, ok := parent(qname); ok; name, ok = parent(name) {
+		if nsrrs := r.cache.get(name, "NS").Answer; len(nsrrs) > 0 && !r.deadGlue(name, findNS(nsrrs)) {
+			return nsrrs
+		}
+	}
+	return nil
+}
+
+// isReferral returns true if a nameserver of zone referred to the nameservers of a zone below it, which holds qname
+func isReferral(rmsg *dns.Msg, zone, qname string) bool {
+	if rmsg.Authoritative || len(rmsg.Answer) > 0 {
+		return false
+	}
+	for _, rr := range filterRR(rmsg.Ns, dns.TypeNS) {
+		owner := toLowerFQDN(rr.Header().Name)
+		if owner != zone && dns.IsSubDomain(zone, owner) && dns.IsSubDomain(owner, qname) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadGlue returns true if all nameservers of zone are inside the zone and none has a cached address, so their addresses
+// can only be found in the glue of the parent zone
+func (r *Resolver) deadGlue(zone string, ns []string) bool {
+	if len(ns) == 0 {
+		return false
+	}
+	for _, name := range ns {
+		if !dns.IsSubDomain(zone, name) {
+			return false
+		}
+		if len(r.cache.get(name, "A").Answer) > 0 || len(r.cache.get(name, "AAAA").Answer) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// queryRouted queries the servers a router returned, asking them to recurse
+func (r *Resolver) queryRouted(ctx context.Context, servers []string, qname, qtype string, qs *queryState, depth int) (*dns.Msg, error) {
+	if len(servers) == 0 {
+		return nil, ErrRefused
+	}
+	rmsg, err := r.queryMultiple(context.WithValue(ctx, recursionDesiredKey, true), servers, qname, qtype, qs, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	r.cacheResponse(qname, qtype, "", rmsg)
+	return rmsg, nil
+}
+
+// cacheResponse adds the records of a response from a nameserver of zone to the cache, and sets the TTLs in the response
+// to those in the cache. The zone is empty if the response did not come from a nameserver of the zone, such as a forwarder
+func (r *Resolver) cacheResponse(qname, qtype, zone string, rmsg *dns.Msg) {
+	r.m.RLock()
+	authOnly := r.authOnly
+	strict := r.strict
+	r.m.RUnlock()
+	cmsg := rmsg
+	if authOnly && !rmsg.Authoritative {
+		// only keep the delegation, the answer for the queried name is not from an authoritative source
+		cmsg = &dns.Msg{Ns: rmsg.Ns, Extra: rmsg.Extra}
+	}
+	if strict && rmsg.Authoritative {
+		// NS records published by the zone itself are not cached, so only the delegation of the parent is used to select nameservers
+		cmsg = &dns.Msg{MsgHdr: dns.MsgHdr{Authoritative: true}, Answer: withoutRR(cmsg.Answer, dns.TypeNS), Ns: withoutRR(cmsg.Ns, dns.TypeNS), Extra: cmsg.Extra}
+	}
+	r.cache.addZoneMsg(cmsg, zone)
+	if !authOnly || rmsg.Authoritative {
+		r.cache.addNegative(qname, qtype, rmsg)
+	}
+
+	// the response presents the TTLs the cache reports from now on, which differ if a record was already
+	// cached for longer. Records that were not cached keep their TTL
+	for _, rrs := range [][]dns.RR{rmsg.Answer, rmsg.Ns, rmsg.Extra} {
+		for _, rr := range rrs {
+			if ttl, ok := r.cache.ttl(rr); ok {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
+
 type queryAnswer struct {
 	msg    *dns.Msg
 	err    error
 	server string
 }
 
-func (r *Resolver) queryMultiple(ctx context.Context, ns []string, qname, qtype string, qs map[string]int, depth int) (*dns.Msg, error) {
-	qa := make(chan queryAnswer)
+func (r *Resolver) queryMultiple(ctx context.Context, ns []string, qname, qtype string, qs *queryState, depth int) (*dns.Msg, error) {
+	// buffered, so a query done without a goroutine can deliver its answer before we start reading
+	r.m.RLock()
+	stagger := r.stagger
+	maxNameservers := r.maxNameservers
+	sequential := r.sequential
+	r.m.RUnlock()
+
+	qa := make(chan queryAnswer, maxNameservers)
 
-	ctx2, cancel := context.WithTimeout(ctx, r.timeout)
+	ctx2, cancel := context.WithTimeout(ctx, r.queryTimeout())
 	defer cancel()
 
-	// shuffle NS's so we don't always query the first server
-	for i := range ns {
-		j := rand.Intn(i + 1)
-		ns[i], ns[j] = ns[j], ns[i]
+	// the nameservers can be those of the forwarders, a router or the options of the caller, they are shuffled in a copy
+	ns = append([]string{}, ns...)
+	r.shuffleNameservers(ns)
+
+	if sequential {
+		// without concurrency the next server is only queried after the previous one failed
+		answer := queryAnswer{err: ErrNoNS}
+		for i := 0; i < maxNameservers && i < len(ns); i++ {
+			r.querySingleChan(ctx2, ns[i], qname, qtype, qa, qs, depth)
+			select {
+			case answer = <-qa:
+			default:
+				// the query was cancelled before it could deliver its answer
+				return nil, ctx2.Err()
+			}
+			if r.debugging() {
+				r.logf("QUERY SEQUENTIAL RESULT depth:%d: %s %s @%s err:%s\n msg:%+v", depth, qname, qtype, answer.server, answer.err, answer.msg)
+			}
+			if answer.err == nil {
+				break
+			}
+		}
+		return answer.msg, answer.err
 	}
 
 	// count instances started
 	count := 0
-	for i := 0; i < MaxNameservers && i < len(ns); i++ {
+	next := 0
+	// start queries the next nameserver, and returns false if there is none left to query
+	start := func() bool {
+		if next >= maxNameservers || next >= len(ns) {
+			return false
+		}
+		nsq := ns[next]
+		next++
+		if !qs.acquire() {
+			// the goroutine budget of this resolution is used up, query a single server without a goroutine
+			next = len(ns)
+			if count == 0 {
+				count++
+				r.querySingleChan(ctx2, nsq, qname, qtype, qa, qs, depth)
+			}
+			return false
+		}
 		count++
-		nsq := ns[i]
 		go func() {
+			defer qs.release()
 			///log.Printf("QUERY  MULTIPLE initiated on depth:%d for [%s] [%s] on %s", depth, qname, qtype, ns)
 			r.querySingleChan(ctx2, nsq, qname, qtype, qa, qs, depth)
 		}()
+		return true
+	}
+
+	// without a stagger delay all servers are queried at once, otherwise the next server is queried
+	// only if the previous did not answer within the delay
+	var staggerTimer <-chan time.Time
+	if stagger <= 0 {
+		for start() {
+		}
+	} else if start() {
+		staggerTimer = time.After(stagger)
 	}
 
 	for {
 		select {
 		case answer := <-qa:
 			count--
+			if answer.err != nil && stagger > 0 && start() {
+				// no need to wait for the delay when a server failed
+				staggerTimer = time.After(stagger)
+				continue
+			}
 			// if we have a valid response or we ran out of servers to query, return the resolt
 			if answer.err == nil || count == 0 {
-				if r.debug {
-					log.Printf("QUERY MULTIPLE RESULT depth:%d: %s %s @%s err:%s\n msg:%+v", depth, qname, qtype, answer.server, answer.err, answer.msg)
+				if r.debugging() {
+					r.logf("QUERY MULTIPLE RESULT depth:%d: %s %s @%s err:%s\n msg:%+v", depth, qname, qtype, answer.server, answer.err, answer.msg)
 				}
 				return answer.msg, answer.err
 			}
+		case <-staggerTimer:
+			staggerTimer = nil
+			if start() {
+				staggerTimer = time.After(stagger)
+			}
 		case <-ctx.Done():
-			if r.debug {
-				log.Printf("QUERY MULTIPLE CTX %d: %s %s", depth, qname, qtype)
+			if r.debugging() {
+				r.logf("QUERY MULTIPLE CTX %d: %s %s", depth, qname, qtype)
 			}
 			return nil, ctx.Err()
 		}
 	}
 }
 
-func (r *Resolver) querySingleChan(ctx context.Context, ns string, qname, qtype string, answer chan queryAnswer, qs map[string]int, depth int) {
+// shuffleNameservers shuffles the NS's so we don't always query the first server, unless shuffling is disabled
+func (r *Resolver) shuffleNameservers(ns []string) {
+	r.m.RLock()
+	shuffle := r.shuffle
+	r.m.RUnlock()
+	if !shuffle {
+		return
+	}
+	for i := range ns {
+		j := r.intn(i + 1)
+		ns[i], ns[j] = ns[j], ns[i]
+	}
+}
+
+func (r *Resolver) querySingleChan(ctx context.Context, ns string, qname, qtype string, answer chan queryAnswer, qs *queryState, depth int) {
 	/*defer func() {
 		if recover() != nil {
 			return
@@ -353,7 +1659,7 @@ func (r *Resolver) querySingleChan(ctx context.Context, ns string, qname, qtype
 }
 
 //func (r *Resolver) querySingle(ctx context.Context, ns string, qname, qtype string) (*dns.Msg, error) {
-func (r *Resolver) querySingle(ctx context.Context, ns string, qname, qtype string, qs map[string]int, depth int) (*dns.Msg, error) {
+func (r *Resolver) querySingle(ctx context.Context, ns string, qname, qtype string, qs *queryState, depth int) (*dns.Msg, error) {
 
 	dtype := dns.StringToType[qtype]
 	if dtype == 0 {
@@ -361,38 +1667,168 @@ func (r *Resolver) querySingle(ctx context.Context, ns string, qname, qtype stri
 	}
 	qmsg := &dns.Msg{}
 	qmsg.SetQuestion(qname, dtype)
+	// resolving is iterative, nameservers are only asked to recurse for us when a router sends the query to them
 	qmsg.MsgHdr.RecursionDesired = false
-	if qtype == "NS" {
+	if rd, _ := ctx.Value(recursionDesiredKey).(bool); rd {
 		qmsg.MsgHdr.RecursionDesired = true
 	}
+	// EDNS allows larger responses, and lets the server explain failures with an extended error
+	qmsg.SetEdns0(qs.opts.ednsBufferSize(), qs.opts.DNSSEC || qs.validate)
+	if qs.opts.NSID {
+		requestNSID(qmsg)
+	}
 
 	ip := ""
 	if !IsIpv4Net(ns) {
 		///log.Printf("Finding A record for NS server depth:%d ns:%s\n", depth, ns)
-		nsa, err := r.queryWithCache(ctx, ns, "A", depth+1, qs)
+		nsip, err := r.nameserverAddr(ctx, ns, qs, depth)
 		if err != nil {
 			return nil, err
 		}
-		nsip := findA(nsa.Answer)
-		if len(nsip) == 0 {
-			return nil, fmt.Errorf("failed to get A record for %s", ns)
-		}
-
-		ip = nsip[0]
+		ip = nsip
 	} else {
 		ip = ns
 	}
+	if qs.opts.blocked(ip) {
+		return nil, ErrBlocked
+	}
 
-	client := &dns.Client{Timeout: r.timeout} // client must finish within remaining timeout
+	client := r.client()
+	if tlsClient := r.tlsClient(ns); tlsClient != nil {
+		client = tlsClient
+	}
+	addr := net.JoinHostPort(ip, r.upstreamPort())
 	///log.Printf("depth:%d executing query on %s, msg:%+v\n", depth, ip, qmsg)
-	rmsg, _, err := client.ExchangeContext(ctx, qmsg, ip+":53")
+	start := r.metrics.queryStart()
+	rmsg, _, err := client.ExchangeContext(ctx, qmsg, addr)
+	r.metrics.queryDone(start, rmsg, err)
+	if reason := r.retryOverTCP(ctx, rmsg, err); reason != "" && client.Net != "tcp-tls" {
+		// ask the same server again over TCP within what is left of the deadline
+		if r.debugging() {
+			r.logf("depth:%d %s for %s %s from %s, retrying over tcp", depth, reason, qname, qtype, ip)
+		}
+		// the source port range only applies to UDP
+		client = r.tcpClient()
+		start = r.metrics.queryStart()
+		rmsg, _, err = client.ExchangeContext(ctx, qmsg, addr)
+		r.metrics.queryDone(start, rmsg, err)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if eerr := extendedError(rmsg); eerr != nil {
+		eerr.Server = ns
+		return nil, eerr
+	}
+	if err := validateResponse(qmsg, rmsg); err != nil {
+		return nil, err
+	}
+	if nsid := nsidOf(rmsg); qs.opts.NSID && nsid != "" {
+		qs.setNSID(qname, qtype, nsid)
+	}
 
 	return rmsg, nil
 }
 
+// nameserverAddr returns the address of a nameserver, following the CNAME chain if the nameserver name is an alias.
+// The IPv6 address is returned if the nameserver has no IPv4 address
+func (r *Resolver) nameserverAddr(ctx context.Context, ns string, qs *queryState, depth int) (string, error) {
+	name := ns
+	for i := 0; i < qs.opts.maxDepth(); i++ {
+		if cname := findCNAME(r.cache.get(name, "CNAME").Answer); len(cname) > 0 {
+			name = toLowerFQDN(cname[0])
+			continue
+		}
+		if nsip := findA(r.cache.get(name, "A").Answer); len(nsip) > 0 {
+			return nsip[0], nil
+		}
+		// with only IPv6 glue, resolving the IPv4 address would ask the nameserver we are trying to reach
+		if nsip := findAAAA(r.cache.get(name, "AAAA").Answer); len(nsip) > 0 {
+			return nsip[0], nil
+		}
+		if !qs.lookupNS(name) {
+			return "", ErrMaxNSLookups
+		}
+		nsa, err := r.queryWithCache(ctx, name, "A", depth+1, qs)
+		if err != nil {
+			return "", err
+		}
+		if nsip := findA(nsa.Answer); len(nsip) > 0 {
+			return nsip[0], nil
+		}
+		// the nameserver name is an alias, continue with the end of its cname chain
+		target := cnameTarget(nsa.Answer, name)
+		if target == name {
+			// without an IPv4 address the nameserver can still be reachable over IPv6
+			nsaaaa, err := r.queryWithCache(ctx, name, "AAAA", depth+1, qs)
+			if err == nil {
+				if nsip := findAAAA(nsaaaa.Answer); len(nsip) > 0 {
+					return nsip[0], nil
+				}
+			}
+			break
+		}
+		name = target
+	}
+	return "", fmt.Errorf("failed to get A or AAAA record for %s", ns)
+}
+
+// retryOverTCP returns why a UDP query should be asked again over TCP, or an empty string if it should not
+func (r *Resolver) retryOverTCP(ctx context.Context, rmsg *dns.Msg, err error) string {
+	if err == nil && rmsg.Truncated {
+		// the answer did not fit in a UDP packet
+		return "truncated response"
+	}
+	r.m.RLock()
+	enabled := r.tcpRetry
+	r.m.RUnlock()
+	switch {
+	case !enabled || ctx.Err() != nil:
+		return ""
+	case err != nil:
+		return "no response"
+	case rmsg.Rcode == dns.RcodeServerFailure:
+		return "server failure"
+	}
+	return ""
+}
+
+// validateResponse checks if a response answers the query, a response that fails is not used or cached
+func validateResponse(qmsg, rmsg *dns.Msg) error {
+	if len(rmsg.Question) != 1 || toLowerFQDN(rmsg.Question[0].Name) != toLowerFQDN(qmsg.Question[0].Name) || rmsg.Question[0].Qtype != qmsg.Question[0].Qtype {
+		return fmt.Errorf("%w: question does not match the query", ErrInvalidResponse)
+	}
+	if rmsg.Rcode != dns.RcodeSuccess && rmsg.Rcode != dns.RcodeNameError {
+		return &DNSError{Name: toLowerFQDN(qmsg.Question[0].Name), Rcode: rmsg.Rcode}
+	}
+	return nil
+}
+
+// filterZone returns the zone of the first NS or SOA record
+func filterZone(rrs []dns.RR) string {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeNS || rr.Header().Rrtype == dns.TypeSOA {
+			return toLowerFQDN(rr.Header().Name)
+		}
+	}
+	return "."
+}
+
+// scrubBailiwick removes all records outside of zone from a response
+func scrubBailiwick(msg *dns.Msg, zone string) {
+	inZone := func(rrs []dns.RR) (res []dns.RR) {
+		for _, rr := range rrs {
+			if dns.IsSubDomain(zone, toLowerFQDN(rr.Header().Name)) {
+				res = append(res, rr)
+			}
+		}
+		return
+	}
+	msg.Answer = inZone(msg.Answer)
+	msg.Ns = inZone(msg.Ns)
+	msg.Extra = inZone(msg.Extra)
+}
+
 func parent(name string) (string, bool) {
 	labels := dns.SplitDomainName(name)
 	if labels == nil {
@@ -421,9 +1857,19 @@ func findNS(rrs []dns.RR) (res []string) {
 
 func findMX(rrs []dns.RR) (res []string) {
 	for _, rr := range rrs {
-		if rr.Header().Rrtype == dns.TypeMX {
-			value := strings.Split(rr.String(), "\t")[4]
-			res = append(res, strings.Split(value, " ")[1])
+		switch v := rr.(type) {
+		case *dns.MX:
+			res = append(res, v.Mx)
+		}
+	}
+	return
+}
+
+// findSRV returns the targets of the SRV records
+func findSRV(rrs []dns.RR) (res []string) {
+	for _, rr := range rrs {
+		if srv, ok := rr.(*dns.SRV); ok {
+			res = append(res, srv.Target)
 		}
 	}
 	return
@@ -442,6 +1888,29 @@ func findA(rrs []dns.RR) (res []string) {
 	return
 }
 
+func findAAAA(rrs []dns.RR) (res []string) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			ip := strings.Split(rr.String(), "\t")[4]
+			res = append(res, ip)
+		}
+	}
+	return
+}
+
+// findIP returns the addresses of the A and AAAA records, without parsing their text form
+func findIP(rrs []dns.RR) (res []net.IP) {
+	for _, rr := range rrs {
+		switch v := rr.(type) {
+		case *dns.A:
+			res = append(res, v.A)
+		case *dns.AAAA:
+			res = append(res, v.AAAA)
+		}
+	}
+	return
+}
+
 func findCNAME(rrs []dns.RR) (res []string) {
 	for _, rr := range rrs {
 		if rr.Header().Rrtype == dns.TypeCNAME {
@@ -452,6 +1921,69 @@ func findCNAME(rrs []dns.RR) (res []string) {
 	return
 }
 
+func findHINFO(rrs []dns.RR) (res []string) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeHINFO {
+			hinfo := strings.Split(rr.String(), "\t")[4]
+			res = append(res, hinfo)
+		}
+	}
+	return
+}
+
+func findLOC(rrs []dns.RR) (res []string) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeLOC {
+			loc := strings.Split(rr.String(), "\t")[4]
+			res = append(res, loc)
+		}
+	}
+	return
+}
+
+// filterRR returns the records of the given type
+func filterRR(rrs []dns.RR, rrtype uint16) (res []dns.RR) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			res = append(res, rr)
+		}
+	}
+	return
+}
+
+// withoutRR returns the records that are not of the given type
+func withoutRR(rrs []dns.RR, rrtype uint16) (res []dns.RR) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != rrtype {
+			res = append(res, rr)
+		}
+	}
+	return
+}
+
+// uniqueNames returns the names with duplicates removed, ignoring case
+func uniqueNames(names []string) (res []string) {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !seen[toLowerFQDN(name)] {
+			seen[toLowerFQDN(name)] = true
+			res = append(res, name)
+		}
+	}
+	return
+}
+
+// hasRR returns true if there is a record with the given name and type in the records
+func hasRR(rrs []dns.RR, name string, rrtype uint16) bool {
+	name = toLowerFQDN(name)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype && toLowerFQDN(rr.Header().Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
 func findNameOfA(rrs []dns.RR) (res []string) {
 	for _, rr := range rrs {
 		if rr.Header().Rrtype == dns.TypeA {
@@ -1,12 +1,25 @@
 package tinyresolver
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -333,6 +346,34 @@ func TestResolving(t *testing.T) {
 				},
 			},
 
+			testRecord{
+				query: testQuery{
+					name:  "one.one.one.one",
+					qtype: "AAAA",
+				},
+				answer: []testResult{
+					testResult{
+						name:  "one.one.one.one.",
+						qtype: "AAAA",
+						value: "2606:4700:4700::1111",
+					},
+				},
+			},
+
+			testRecord{
+				query: testQuery{
+					name:  "one.one.one.one",
+					qtype: "AAAA",
+				},
+				answer: []testResult{
+					testResult{
+						name:  "one.one.one.one.",
+						qtype: "AAAA",
+						value: "2606:4700:4700::1111",
+					},
+				},
+			},
+
 			testRecord{
 				query: testQuery{
 					name:  "175.102.142.95.in-addr.arpa",
@@ -539,7 +580,7 @@ func TestResolving(t *testing.T) {
 
 func (r *Resolver) testResolving(t *testing.T, record testRecord) {
 	rrs, err := r.Resolve(record.query.name, record.query.qtype)
-	if r.debug {
+	if r.debugging() {
 		log.Printf("rr: %+v err:%s", rrs, err)
 	}
 
@@ -604,3 +645,1856 @@ func TestSimple(t *testing.T) {
 	log.Printf("r:%+v e:%s", r.Answer, e)
 }
 */
+
+func TestNormalizeTTL(t *testing.T) {
+	now := time.Now()
+	// the same record set, retrieved at 3 different moments with the TTL as reported at that time
+	first := &dns.CNAME{Hdr: dns.RR_Header{Name: "www.dns.org.", Ttl: 300, Class: dns.ClassINET, Rrtype: dns.TypeCNAME}, Target: "dns.org."}
+	second := &dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 280, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")}
+	third := &dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 5, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.11")}
+
+	normalizeTTL(now,
+		rrSet{rrs: []dns.RR{first}, at: now.Add(-30 * time.Second)},
+		rrSet{rrs: []dns.RR{second}, at: now.Add(-10 * time.Second)},
+		rrSet{rrs: []dns.RR{third}, at: now.Add(-10 * time.Second)},
+	)
+	assert.Equal(t, uint32(270), first.Header().Ttl)
+	assert.Equal(t, uint32(270), second.Header().Ttl)
+	assert.Equal(t, uint32(0), third.Header().Ttl)
+
+	// a CNAME resolved now pointing to a target cached 100 seconds ago presents the TTL of the target
+	resolver, _ := newMockResolver(t,
+		"www.test. 3600 IN CNAME target.test.",
+		"target.test. 3600 IN A 10.10.10.10",
+	)
+	resolver.cache.setClock(func() time.Time { return now.Add(-100 * time.Second) })
+	_, err := resolver.Resolve("target.test", "A")
+	assert.Nil(t, err)
+	resolver.cache.setClock(func() time.Time { return now })
+	rr, err := resolver.Resolve("www.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rr.Answer))
+	for _, answer := range rr.Answer {
+		assert.Equal(t, uint32(3500), answer.Header().Ttl, answer.String())
+	}
+}
+
+func TestShuffleNameservers(t *testing.T) {
+	resolver := New()
+	order := []string{"a.ns.org.", "b.ns.org.", "c.ns.org.", "d.ns.org.", "e.ns.org."}
+
+	// with shuffle enabled the order should change at some point
+	shuffled := false
+	for i := 0; i < 100; i++ {
+		ns := append([]string{}, order...)
+		resolver.shuffleNameservers(ns)
+		if ns[0] != order[0] {
+			shuffled = true
+		}
+	}
+	assert.True(t, shuffled)
+
+	// with shuffle disabled the first NS is always queried first
+	resolver.SetShuffleNameservers(false)
+	for i := 0; i < 100; i++ {
+		ns := append([]string{}, order...)
+		resolver.shuffleNameservers(ns)
+		assert.Equal(t, order, ns)
+	}
+
+	// and a resolution only queries the first NS listed by the delegation
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"test. 3600 IN NS ns2.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"ns2.test. 3600 IN A 127.0.0.12",
+	)
+	var servers []*mockServer
+	for _, ip := range []string{"127.0.0.11", "127.0.0.12"} {
+		servers = append(servers, mn.addServer(ip, "test.",
+			"test. 3600 IN NS ns1.test.",
+			"test. 3600 IN NS ns2.test.",
+			"ns1.test. 3600 IN A 127.0.0.11",
+			"ns2.test. 3600 IN A 127.0.0.12",
+			"www.test. 3600 IN A 10.10.10.10",
+		))
+	}
+	resolver = mn.resolver("127.0.0.10")
+	resolver.SetShuffleNameservers(false)
+	resolver.SetMaxNameservers(1)
+	for i := 0; i < 10; i++ {
+		resolver.FlushName("www.test")
+		rr, err := resolver.Resolve("www.test", "A")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	}
+	assert.Equal(t, 10, servers[0].received("www.test", "A"))
+	assert.Equal(t, 0, servers[1].received("www.test", "A"))
+}
+
+func TestMaxRecords(t *testing.T) {
+	resolver := New()
+	for i := 1; i <= 10; i++ {
+		resolver.cache.addRR(&dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP(fmt.Sprintf("10.10.10.%d", i))})
+	}
+
+	// without a limit everything is returned
+	rr, err := resolver.Resolve("dns.org", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(rr.Answer))
+	assert.False(t, rr.Truncated)
+
+	// with a limit only what fits is returned, and the message is marked truncated
+	resolver.SetMaxRecords(3)
+	rr, err = resolver.Resolve("dns.org", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(rr.Answer))
+	assert.True(t, rr.Truncated)
+
+	// answers are kept before the other sections
+	msg := &dns.Msg{}
+	msg.Answer = rr.Answer[:2]
+	msg.Ns = rr.Answer[:2]
+	msg.Extra = rr.Answer[:2]
+	assert.True(t, truncateMsg(msg, 3))
+	assert.Equal(t, 2, len(msg.Answer))
+	assert.Equal(t, 1, len(msg.Ns))
+	assert.Equal(t, 0, len(msg.Extra))
+}
+
+func TestNameserverAddrCNAME(t *testing.T) {
+	resolver := New()
+	resolver.cache.addRR(&dns.CNAME{Hdr: dns.RR_Header{Name: "ns1.dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeCNAME}, Target: "host.dns.net."})
+	resolver.cache.addRR(&dns.A{Hdr: dns.RR_Header{Name: "host.dns.net.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.53")})
+
+	ip, err := resolver.nameserverAddr(context.Background(), "ns1.dns.org.", newQueryState(0), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.10.10.53", ip)
+}
+
+func TestNameserverAddrIPv6(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN AAAA ::1",
+	)
+	v6 := mn.addServer("::1", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN AAAA ::1",
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	resolver := mn.resolver("127.0.0.10")
+
+	// the nameserver only has AAAA glue, so it is queried over IPv6
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 1, v6.received("www.dns.test.", "A"))
+}
+
+func TestIncompleteCNAME(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	server := mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"www.dns.test. 3600 IN CNAME dns.test.",
+		"dns.test. 3600 IN A 10.10.10.10",
+		"missing.dns.test. 3600 IN CNAME nxdomain.dns.test.",
+		"broken.dns.test. 3600 IN CNAME failing.dns.test.",
+		"failing.dns.test. 3600 IN A 10.10.10.11",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "failing.dns.test." {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+		return true
+	})
+	resolver := mn.resolver("127.0.0.10")
+
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+
+	// a target without records of the type is a NODATA answer for the chain, not an incomplete one
+	rr, err = resolver.Resolve("www.dns.test", "AAAA")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dns.test."}, findCNAME(rr.Answer))
+	assert.Equal(t, 0, len(findAAAA(rr.Answer)))
+	assert.True(t, hasSOA(rr.Ns))
+
+	// as is a target that does not exist
+	rr, err = resolver.Resolve("missing.dns.test", "A")
+	assert.True(t, errors.Is(err, ErrNXDomain), "%v", err)
+	assert.Equal(t, []string{"nxdomain.dns.test."}, findCNAME(rr.Answer))
+
+	// the cname is returned, but the caller learns the address is missing
+	rr, err = resolver.Resolve("broken.dns.test", "A")
+	assert.Equal(t, ErrIncompleteCNAME, err)
+	assert.Equal(t, []string{"failing.dns.test."}, findCNAME(rr.Answer))
+	assert.Equal(t, 0, len(findA(rr.Answer)))
+}
+
+func TestMaxGoroutinesPerResolve(t *testing.T) {
+	// test. is served by 6 slow nameservers, keeping track of how many queries are handled at the same time
+	mn := newMockNet(t)
+	root := []string{}
+	zone := []string{"host.test. 3600 IN A 10.10.10.10"}
+	for i := 1; i <= 6; i++ {
+		root = append(root, fmt.Sprintf("test. 3600 IN NS ns%d.test.", i), fmt.Sprintf("ns%d.test. 3600 IN A 127.0.0.%d", i, 10+i))
+		zone = append(zone, fmt.Sprintf("test. 3600 IN NS ns%d.test.", i), fmt.Sprintf("ns%d.test. 3600 IN A 127.0.0.%d", i, 10+i))
+	}
+	mn.addServer("127.0.0.10", ".", root...)
+	var inflight, peak int32
+	for i := 1; i <= 6; i++ {
+		s := mn.addServer(fmt.Sprintf("127.0.0.%d", 10+i), "test.", zone...)
+		s.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+			n := atomic.AddInt32(&inflight, 1)
+			for p := atomic.LoadInt32(&peak); n > p && !atomic.CompareAndSwapInt32(&peak, p, n); p = atomic.LoadInt32(&peak) {
+			}
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&inflight, -1)
+			return false
+		})
+	}
+
+	// without a budget, MaxNameservers servers are queried at once
+	resolver := mn.resolver("127.0.0.10")
+	_, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(MaxNameservers), atomic.LoadInt32(&peak))
+
+	// with a budget, no more than that are queried at once
+	atomic.StoreInt32(&peak, 0)
+	resolver = mn.resolver("127.0.0.10")
+	resolver.SetMaxGoroutinesPerResolve(2)
+	rr, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.True(t, atomic.LoadInt32(&peak) <= 2, "peak of %d concurrent queries", atomic.LoadInt32(&peak))
+}
+
+func TestResolveHINFOLOC(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"host.dns.test. 3600 IN HINFO \"INTEL-386\" \"Linux\"",
+		"host.dns.test. 3600 IN LOC 52 22 23.000 N 4 53 32.000 E -2.00m 1m 10000m 10m",
+	)
+
+	rr, err := resolver.Resolve("host.dns.test", "HINFO")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"\"INTEL-386\" \"Linux\""}, findHINFO(rr.Answer))
+	hinfo := rr.Answer[0].(*dns.HINFO)
+	assert.Equal(t, "INTEL-386", hinfo.Cpu)
+	assert.Equal(t, "Linux", hinfo.Os)
+
+	rr, err = resolver.Resolve("host.dns.test", "LOC")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"52 22 23.000 N 04 53 32.000 E -2m 1m 10000m 10m"}, findLOC(rr.Answer))
+	loc := rr.Answer[0].(*dns.LOC)
+	assert.Equal(t, uint32(dns.LOC_EQUATOR+(52*3600+22*60+23)*1000), loc.Latitude)
+	assert.Equal(t, uint32(dns.LOC_PRIMEMERIDIAN+(4*3600+53*60+32)*1000), loc.Longitude)
+}
+
+func TestCacheAuthoritativeOnly(t *testing.T) {
+	resolver, server := newMockResolver(t)
+	// the server answers like a forwarder, without the authoritative flag
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "forwarded.dns.test." {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		rr, _ := dns.NewRR("forwarded.dns.test. 3600 IN A 10.10.10.10")
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+		return true
+	})
+
+	resolver.SetCacheAuthoritativeOnly(true)
+	rr, err := resolver.Resolve("forwarded.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 0, len(resolver.cache.get("forwarded.dns.test.", "A").Answer))
+
+	resolver.SetCacheAuthoritativeOnly(false)
+	_, err = resolver.Resolve("forwarded.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resolver.cache.get("forwarded.dns.test.", "A").Answer))
+}
+
+func TestStaggerDelay(t *testing.T) {
+	mn := newMockNet(t)
+	delegation := []string{
+		"test. 3600 IN NS ns1.test.",
+		"test. 3600 IN NS ns2.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"ns2.test. 3600 IN A 127.0.0.12",
+	}
+	mn.addServer("127.0.0.10", ".", delegation...)
+	zone := append([]string{"host.test. 3600 IN A 10.10.10.10"}, delegation...)
+	mn.addServer("127.0.0.11", "test.", zone...)
+	slow := mn.addServer("127.0.0.12", "test.", zone...)
+
+	// without a stagger delay both servers are queried
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetShuffleNameservers(false)
+	_, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	slow.m.Lock()
+	assert.True(t, len(slow.queries) > 0)
+	slow.queries = nil
+	slow.m.Unlock()
+
+	// with a stagger delay, the fast first server answers before the second is tried
+	resolver = mn.resolver("127.0.0.10")
+	resolver.SetShuffleNameservers(false)
+	resolver.SetStaggerDelay(500 * time.Millisecond)
+	rr, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	slow.m.Lock()
+	assert.Equal(t, 0, len(slow.queries))
+	slow.m.Unlock()
+}
+
+func TestDuplicateNS(t *testing.T) {
+	mn := newMockNet(t)
+	root := mn.addServer("127.0.0.10", ".")
+	// the root lists the same nameserver in both the answer and authority section
+	root.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for _, record := range []string{"test. 3600 IN NS ns1.test.", "test. 3600 IN NS NS1.test."} {
+			rr, _ := dns.NewRR(record)
+			resp.Answer = append(resp.Answer, rr)
+			rr, _ = dns.NewRR(record)
+			resp.Ns = append(resp.Ns, rr)
+		}
+		rr, _ := dns.NewRR("ns1.test. 3600 IN A 127.0.0.11")
+		resp.Extra = append(resp.Extra, rr)
+		w.WriteMsg(resp)
+		return true
+	})
+	server := mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"host.test. 3600 IN A 10.10.10.10",
+	)
+	resolver := mn.resolver("127.0.0.10")
+
+	rr, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 1, server.received("host.test.", "A"))
+
+	ns := uniqueNames([]string{"ns1.test.", "NS1.test.", "ns2.test"})
+	assert.Equal(t, []string{"ns1.test.", "ns2.test"}, ns)
+}
+
+func TestStrictDelegation(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+	)
+	// the zone claims an extra nameserver, not delegated by the parent, and adds its NS records to each answer
+	zone := []string{
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"dns.test. 3600 IN NS rogue.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+		"rogue.dns.test. 3600 IN A 127.0.0.13",
+		"www.dns.test. 3600 IN A 10.10.10.10",
+		"mail.dns.test. 3600 IN A 10.10.10.11",
+	}
+	child := mn.addServer("127.0.0.12", "dns.test.", zone...)
+	child.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		resp := child.answer(req)
+		if resp.Authoritative && len(resp.Answer) > 0 {
+			resp.Ns = append(resp.Ns, child.find("dns.test.", dns.TypeNS)...)
+			resp.Extra = append(resp.Extra, child.glue(resp.Ns)...)
+		}
+		if req.Question[0].Name == "mail.dns.test." {
+			// give the other nameserver a chance to answer first
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.WriteMsg(resp)
+		return true
+	})
+	rogue := mn.addServer("127.0.0.13", "dns.test.", zone...)
+
+	// by default the nameservers published by the zone are used as well
+	resolver := mn.resolver("127.0.0.10")
+	_, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	_, err = resolver.Resolve("mail.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rogue.received("mail.dns.test.", "A"))
+	assert.Contains(t, findNS(resolver.cache.get("dns.test.", "NS").Answer), "rogue.dns.test.")
+
+	// in strict mode only the delegation of the parent is used
+	resolver = mn.resolver("127.0.0.10")
+	resolver.SetStrictDelegation(true)
+	_, err = resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	rr, err := resolver.Resolve("mail.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.11"}, findA(rr.Answer))
+	assert.Equal(t, 1, rogue.received("mail.dns.test.", "A"))
+	assert.NotContains(t, findNS(resolver.cache.get("dns.test.", "NS").Answer), "rogue.dns.test.")
+}
+
+func TestServedZones(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+		"www.other.test. 3600 IN A 10.10.10.11",
+	)
+	resolver.SetServedZones([]string{"dns.test"})
+
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+
+	// names outside the served zones are refused, without asking any server
+	rr, err = resolver.Resolve("www.other.test", "A")
+	assert.Equal(t, ErrRefused, err)
+	assert.Nil(t, rr)
+	assert.Equal(t, 0, server.received("www.other.test.", "A"))
+
+	// without served zones, everything is resolved
+	resolver.SetServedZones(nil)
+	rr, err = resolver.Resolve("www.other.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.11"}, findA(rr.Answer))
+}
+
+func TestFindIP(t *testing.T) {
+	rrs := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeCNAME}, Target: "dns.org."},
+		&dns.A{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.11")},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("2001:db8::1")},
+	}
+
+	ips := findIP(rrs)
+	assert.Equal(t, 3, len(ips))
+	for i, ip := range findA(rrs) {
+		assert.True(t, net.ParseIP(ip).Equal(ips[i]))
+	}
+	assert.True(t, net.ParseIP("2001:db8::1").Equal(ips[2]))
+}
+
+func TestInvalidResponseNotCached(t *testing.T) {
+	resolver, server := newMockResolver(t)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		switch req.Question[0].Name {
+		case "mismatch.test.":
+			// answers a question that was not asked
+			resp.Question[0].Name = "other.test."
+			rr, _ := dns.NewRR("mismatch.test. 3600 IN A 10.10.10.10")
+			resp.Answer = append(resp.Answer, rr)
+		case "servfail.test.":
+			resp.Rcode = dns.RcodeServerFailure
+			rr, _ := dns.NewRR("servfail.test. 3600 IN A 10.10.10.11")
+			resp.Answer = append(resp.Answer, rr)
+		case "bailiwick.test.":
+			resp.Authoritative = true
+			rr, _ := dns.NewRR("bailiwick.test. 3600 IN A 10.10.10.12")
+			out, _ := dns.NewRR("victim.example. 3600 IN A 10.10.10.13")
+			resp.Answer = append(resp.Answer, rr, out)
+			resp.Extra = append(resp.Extra, out)
+		default:
+			return false
+		}
+		w.WriteMsg(resp)
+		return true
+	})
+
+	_, err := resolver.Resolve("mismatch.test", "A")
+	assert.True(t, errors.Is(err, ErrInvalidResponse))
+	assert.Equal(t, 0, len(resolver.cache.get("mismatch.test.", "A").Answer))
+
+	_, err = resolver.Resolve("servfail.test", "A")
+	assert.True(t, errors.Is(err, ErrInvalidResponse))
+	assert.True(t, errors.Is(err, ErrServFail))
+	assert.False(t, errors.Is(err, ErrNXDomain))
+	assert.Equal(t, 0, len(resolver.cache.get("servfail.test.", "A").Answer))
+
+	rr, err := resolver.Resolve("bailiwick.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.12"}, findA(rr.Answer))
+	assert.Equal(t, 1, len(resolver.cache.get("bailiwick.test.", "A").Answer))
+	assert.Equal(t, 0, len(resolver.cache.get("victim.example.", "A").Answer))
+}
+
+func TestSearchDomains(t *testing.T) {
+	mn := newMockNet(t)
+	root := mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	server := mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"myhost.corp.test. 3600 IN A 10.10.10.10",
+		"myhost.other.test. 3600 IN TXT \"no address\"",
+	)
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetSearchDomains([]string{"Other.test", "corp.test."})
+
+	// the name has less dots than ndots, so the search domains are tried before the bare name
+	rr, err := resolver.Resolve("myhost", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 1, server.received("myhost.other.test.", "A"))
+	assert.Equal(t, 0, root.received("myhost.", "A"))
+
+	assert.Equal(t, []string{"myhost.other.test.", "myhost.corp.test.", "myhost."}, resolver.searchNames("myhost"))
+	assert.Equal(t, []string{"my.host.", "my.host.other.test.", "my.host.corp.test."}, resolver.searchNames("my.host"))
+	assert.Equal(t, []string{"myhost."}, resolver.searchNames("myhost."))
+	resolver.SetNdots(0)
+	assert.Equal(t, []string{"myhost.", "myhost.other.test.", "myhost.corp.test."}, resolver.searchNames("myhost"))
+}
+
+func TestDebugRace(t *testing.T) {
+	records := []string{}
+	for i := 0; i < 10; i++ {
+		records = append(records, fmt.Sprintf("host%d.dns.test. 3600 IN A 10.10.10.%d", i, i))
+	}
+	resolver, _ := newMockResolver(t, records...)
+	// the debug output is not of interest here
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				resolver.Debug(i%2 == 0)
+			}
+		}
+	}()
+	// every name is new, so each resolution runs the full query path while debug is toggled
+	for i := 0; i < 10; i++ {
+		_, err := resolver.Resolve(fmt.Sprintf("host%d.dns.test", i), "A")
+		assert.Nil(t, err)
+	}
+	close(stop)
+	<-done
+}
+
+func TestNoDataRetry(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"nodata.dns.test. 3600 IN TXT \"no address\"",
+		"flaky.dns.test. 3600 IN A 10.10.10.10",
+	)
+	// the first query for flaky gets an empty answer without SOA, as a misbehaving server would send
+	var flaky int32
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "flaky.dns.test." || atomic.AddInt32(&flaky, 1) > 1 {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+		return true
+	})
+
+	rr, err := resolver.Resolve("nodata.dns.test", "A")
+	assert.Nil(t, err)
+	assert.True(t, IsNoData(rr))
+	assert.Equal(t, 1, server.received("nodata.dns.test.", "A"))
+
+	rr, err = resolver.Resolve("missing.dns.test", "A")
+	assert.True(t, errors.Is(err, ErrNXDomain))
+	assert.True(t, IsNXDomain(rr))
+	assert.Equal(t, 1, server.received("missing.dns.test.", "A"))
+
+	rr, err = resolver.Resolve("flaky.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 2, server.received("flaky.dns.test.", "A"))
+}
+
+func TestNegativeAAAA(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"v4only.dns.test. 3600 IN A 10.10.10.10",
+	)
+
+	for i := 0; i < 2; i++ {
+		rr, err := resolver.Resolve("v4only.dns.test", "A")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+
+		rr, err = resolver.Resolve("v4only.dns.test", "AAAA")
+		assert.Nil(t, err)
+		assert.True(t, IsNoData(rr))
+	}
+	// the second AAAA lookup is answered by the negative cache
+	assert.Equal(t, 1, server.received("v4only.dns.test.", "AAAA"))
+}
+
+func TestNegativeNXDomain(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+
+	for i := 0; i < 2; i++ {
+		rr, err := resolver.Resolve("missing.dns.test", "A")
+		assert.True(t, errors.Is(err, ErrNXDomain))
+		assert.True(t, IsNXDomain(rr))
+		assert.Equal(t, 1, len(rr.Ns))
+	}
+	// the second lookup is answered by the negative cache, without walking the delegation again
+	assert.Equal(t, 1, server.received("missing.dns.test.", "A"))
+}
+
+func TestRouter(t *testing.T) {
+	mn := newMockNet(t)
+	root := mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	internal := mn.addServer("127.0.0.21", "internal.",
+		"host.internal. 3600 IN A 192.168.0.10",
+	)
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetRouter(func(qname, qtype string) ([]string, bool) {
+		if dns.IsSubDomain("internal.", qname) {
+			return []string{"127.0.0.21"}, false
+		}
+		if dns.IsSubDomain("blocked.test.", qname) {
+			return nil, false
+		}
+		return nil, true
+	})
+
+	rr, err := resolver.Resolve("host.internal", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.0.10"}, findA(rr.Answer))
+	assert.Equal(t, 0, root.received("host.internal.", "A"))
+	assert.Equal(t, 1, internal.received("host.internal.", "A"))
+	internal.m.Lock()
+	assert.True(t, internal.queries[0].RecursionDesired)
+	internal.m.Unlock()
+
+	rr, err = resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 0, internal.received("www.dns.test.", "A"))
+
+	_, err = resolver.Resolve("www.blocked.test", "A")
+	assert.Equal(t, ErrRefused, err)
+}
+
+func TestNSRefresh(t *testing.T) {
+	mn := newMockNet(t)
+	root := mn.addServer("127.0.0.10", ".",
+		"test. 1 IN NS ns1.test.",
+		"ns1.test. 1 IN A 127.0.0.11",
+	)
+	server := mn.addServer("127.0.0.11", "test.",
+		"test. 1 IN NS ns1.test.",
+		"ns1.test. 1 IN A 127.0.0.11",
+		"one.test. 3600 IN A 10.10.10.1",
+		"two.test. 3600 IN A 10.10.10.2",
+		"three.test. 3600 IN A 10.10.10.3",
+	)
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetNSRefresh(0.5)
+	resolver.SetEDNSBufferSize(4000)
+
+	_, err := resolver.Resolve("one.test", "A")
+	assert.Nil(t, err)
+
+	// using the delegation with less than half of its TTL left refreshes it in the background
+	time.Sleep(600 * time.Millisecond)
+	_, err = resolver.Resolve("two.test", "A")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return server.received("test.", "NS") > 0 }, time.Second, 10*time.Millisecond)
+	// with the settings of the resolver
+	assert.Equal(t, uint16(4000), server.lastQuery("test.", "NS").IsEdns0().UDPSize())
+
+	// past the original TTL the delegation is still cached, so the root is not asked again
+	delegations := root.received("test.", "NS")
+	time.Sleep(500 * time.Millisecond)
+	_, err = resolver.Resolve("three.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, root.received("three.test.", "A"))
+	assert.Equal(t, delegations, root.received("test.", "NS"))
+}
+
+func TestResolveBestEffort(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN CNAME slow.dns.test.",
+		"slow.dns.test. 3600 IN A 10.10.10.10",
+		"fast.dns.test. 3600 IN A 10.10.10.11",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name == "slow.dns.test." {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return false
+	})
+
+	start := time.Now()
+	rr, incomplete, err := resolver.ResolveBestEffort(context.Background(), "www.dns.test", "A", time.Now().Add(200*time.Millisecond))
+	assert.Nil(t, err)
+	assert.True(t, incomplete)
+	assert.True(t, time.Since(start) < 450*time.Millisecond)
+	// the cname was resolved before the deadline, its target was not
+	assert.Equal(t, []string{"slow.dns.test."}, findCNAME(rr.Answer))
+	assert.Equal(t, 0, len(findA(rr.Answer)))
+
+	rr, incomplete, err = resolver.ResolveBestEffort(context.Background(), "fast.dns.test", "A", time.Now().Add(time.Second))
+	assert.Nil(t, err)
+	assert.False(t, incomplete)
+	assert.Equal(t, []string{"10.10.10.11"}, findA(rr.Answer))
+}
+
+func TestMaxNSLookups(t *testing.T) {
+	resolver, server := newMockResolver(t)
+	// every zone is delegated to nameservers without glue, each in a zone of its own which is delegated the same way,
+	// so each nameserver address lookup needs the addresses of more nameservers
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		labels := dns.SplitDomainName(req.Question[0].Name)
+		if len(labels) < 2 {
+			return false
+		}
+		zone := labels[len(labels)-2]
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for i := 0; i < MaxNameservers; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s.test. 3600 IN NS ns.%s%d.test.", zone, zone, i))
+			resp.Ns = append(resp.Ns, rr)
+		}
+		w.WriteMsg(resp)
+		return true
+	})
+
+	_, err := resolver.Resolve("www.z.test", "A")
+	assert.Equal(t, ErrMaxNSLookups, err)
+	server.m.Lock()
+	queries := len(server.queries)
+	server.m.Unlock()
+	assert.True(t, queries <= 2*MaxNSLookups, "%d queries", queries)
+}
+
+func TestStoredTTL(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+		"www.dns.test. 3600 IN MX 10 mail.dns.test.",
+		"mail.dns.test. 300 IN A 10.10.10.11",
+	)
+	// the address of the mail server is already cached for longer than the nameserver reports
+	resolver.cache.addRR(&dns.A{Hdr: dns.RR_Header{Name: "mail.dns.test.", Ttl: 7200, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.11")})
+
+	stored, err := resolver.queryWithCache(context.Background(), "www.dns.test.", "A", 0, newQueryState(0))
+	assert.Nil(t, err)
+	cached := resolver.cache.get("www.dns.test.", "A")
+	assert.Equal(t, cached.Answer[0].Header().Ttl, stored.Answer[0].Header().Ttl)
+
+	// the glue in the response has the TTL of the cached record
+	stored, err = resolver.queryWithCache(context.Background(), "www.dns.test.", "MX", 0, newQueryState(0))
+	assert.Nil(t, err)
+	cached = resolver.cache.get("mail.dns.test.", "A")
+	assert.Equal(t, []string{"10.10.10.11"}, findA(stored.Extra))
+	assert.Equal(t, cached.Answer[0].Header().Ttl, stored.Extra[0].Header().Ttl)
+}
+
+func TestIterativeNS(t *testing.T) {
+	mn := newMockNet(t)
+	root := mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	server := mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+	)
+	child := mn.addServer("127.0.0.12", "dns.test.",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	resolver := mn.resolver("127.0.0.10")
+
+	_, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	_, err = resolver.Resolve("dns.test", "NS")
+	assert.Nil(t, err)
+
+	// delegations are followed with referrals, none of the servers is asked to recurse
+	ns := 0
+	for _, s := range []*mockServer{root, server, child} {
+		s.m.Lock()
+		for _, q := range s.queries {
+			assert.False(t, q.RecursionDesired, "%s %s", s.ip, q.Question[0].String())
+			if q.Question[0].Qtype == dns.TypeNS {
+				ns++
+			}
+		}
+		s.m.Unlock()
+	}
+	assert.True(t, ns > 0)
+}
+
+func TestAuthoritativeOverGlue(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+	)
+	// the glue at the parent is outdated, the zone moved its nameserver to a new address
+	zone := []string{
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.13",
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	}
+	mn.addServer("127.0.0.12", "dns.test.", zone...)
+	moved := mn.addServer("127.0.0.13", "dns.test.", zone...)
+	resolver := mn.resolver("127.0.0.10")
+
+	_, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.12"}, findA(resolver.cache.get("ns1.dns.test.", "A").Answer))
+
+	rr, err := resolver.Resolve("ns1.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.13"}, findA(rr.Answer))
+	assert.Equal(t, []string{"127.0.0.13"}, findA(resolver.cache.get("ns1.dns.test.", "A").Answer))
+
+	// the nameserver is now reached at its authoritative address
+	_, err = resolver.Resolve("mail.dns.test", "A")
+	assert.True(t, errors.Is(err, ErrNXDomain))
+	assert.Equal(t, 1, moved.received("mail.dns.test.", "A"))
+}
+
+func TestResolveAAAA(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN CNAME host.other.test.",
+		"host.other.test. 3600 IN AAAA 2001:db8::10",
+		"host.other.test. 3600 IN A 10.10.10.10",
+	)
+
+	rr, err := resolver.Resolve("www.dns.test", "AAAA")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host.other.test."}, findCNAME(rr.Answer))
+	assert.Equal(t, []string{"2001:db8::10"}, findAAAA(rr.Answer))
+	assert.Equal(t, 0, len(findA(rr.Answer)))
+
+	// the A records are followed as before
+	rr, err = resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+}
+
+func TestSetTimeout(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		time.Sleep(time.Second)
+		return false
+	})
+
+	resolver.SetTimeout(100 * time.Millisecond)
+	start := time.Now()
+	_, err := resolver.Resolve("www.dns.test", "A")
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	// an invalid timeout falls back to the default
+	resolver.SetTimeout(0)
+	assert.Equal(t, Timeout, resolver.queryTimeout())
+
+	// a raised timeout waits for a server slower than the 2 seconds the dns client defaults to
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		time.Sleep(2500 * time.Millisecond)
+		return false
+	})
+	resolver.SetTimeout(8 * time.Second)
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+}
+
+func TestSetMaxNameserversDepth(t *testing.T) {
+	mn := newMockNet(t)
+	delegation := []string{}
+	for i := 1; i <= 6; i++ {
+		delegation = append(delegation, fmt.Sprintf("test. 3600 IN NS ns%d.test.", i), fmt.Sprintf("ns%d.test. 3600 IN A 127.0.0.%d", i, 10+i))
+	}
+	mn.addServer("127.0.0.10", ".", delegation...)
+	servers := []*mockServer{}
+	for i := 1; i <= 6; i++ {
+		s := mn.addServer(fmt.Sprintf("127.0.0.%d", 10+i), "test.", append([]string{"host.test. 3600 IN A 10.10.10.10"}, delegation...)...)
+		s.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+			time.Sleep(50 * time.Millisecond)
+			return false
+		})
+		servers = append(servers, s)
+	}
+
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetMaxNameservers(2)
+	rr, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	queried := 0
+	for _, s := range servers {
+		queried += s.received("host.test.", "A")
+	}
+	assert.Equal(t, 2, queried)
+
+	// the delegation of test. is deeper than allowed
+	resolver = mn.resolver("127.0.0.10")
+	resolver.SetMaxDepth(1)
+	_, err = resolver.Resolve("host.test", "A")
+	assert.Equal(t, ErrMaxDepth, err)
+
+	// values below 1 are raised to 1
+	resolver.SetMaxDepth(0)
+	resolver.SetMaxNameservers(-1)
+	assert.Equal(t, 1, resolver.maxDepth)
+	assert.Equal(t, 1, resolver.maxNameservers)
+}
+
+func TestDeadGlue(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	parent := mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 60 IN A 127.0.0.12",
+	)
+	mn.addServer("127.0.0.12", "dns.test.",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 60 IN A 127.0.0.12",
+		"www.dns.test. 30 IN A 10.10.10.10",
+		"mail.dns.test. 30 IN A 10.10.10.11",
+	)
+	resolver := mn.resolver("127.0.0.10")
+	now := time.Now()
+	resolver.cache.setClock(func() time.Time { return now })
+
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	referrals := parent.received("mail.dns.test.", "A") + parent.received("dns.test.", "NS")
+
+	// the NS records of dns.test. are still cached, the address of its nameserver is not
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, 1, len(resolver.cache.get("dns.test.", "NS").Answer))
+	assert.Equal(t, 0, len(resolver.cache.get("ns1.dns.test.", "A").Answer))
+
+	rr, err = resolver.Resolve("mail.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.11"}, findA(rr.Answer))
+	// the parent gave the address again
+	assert.True(t, parent.received("mail.dns.test.", "A")+parent.received("dns.test.", "NS") > referrals)
+	assert.Equal(t, []string{"127.0.0.12"}, findA(resolver.cache.get("ns1.dns.test.", "A").Answer))
+}
+
+func TestCacheSweepClose(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 1 IN A 10.10.10.10",
+	)
+	var m sync.Mutex
+	now := time.Now()
+	resolver.cache.setClock(func() time.Time {
+		m.Lock()
+		defer m.Unlock()
+		return now
+	})
+	_, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	size := resolver.cache.size()
+
+	resolver.SetCacheSweep(10 * time.Millisecond)
+	m.Lock()
+	now = now.Add(time.Minute)
+	m.Unlock()
+	assert.Eventually(t, func() bool { return resolver.cache.size() < size }, time.Second, 10*time.Millisecond)
+
+	// after closing, nothing is swept anymore
+	assert.Nil(t, resolver.Close())
+	_, err = resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	size = resolver.cache.size()
+	m.Lock()
+	now = now.Add(time.Minute)
+	m.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, size, resolver.cache.size())
+}
+
+func TestChildNSTTL(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"dns.test. 60 IN NS ns1.dns.test.",
+		"dns.test. 60 IN NS old.dns.test.",
+		"ns1.dns.test. 60 IN A 127.0.0.12",
+		"old.dns.test. 60 IN A 127.0.0.12",
+	)
+	child := mn.addServer("127.0.0.12", "dns.test.",
+		"dns.test. 3600 IN NS ns1.dns.test.",
+		"ns1.dns.test. 3600 IN A 127.0.0.12",
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	// the child lists its own NS records in the authority section of its answers
+	child.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		resp := child.answer(req)
+		if len(resp.Answer) > 0 {
+			resp.Ns = child.find("dns.test.", dns.TypeNS)
+		}
+		w.WriteMsg(resp)
+		return true
+	})
+
+	for _, strict := range []bool{false, true} {
+		resolver := mn.resolver("127.0.0.10")
+		resolver.SetStrictDelegation(strict)
+		now := time.Now()
+		resolver.cache.setClock(func() time.Time { return now })
+		_, err := resolver.Resolve("www.dns.test", "A")
+		assert.Nil(t, err)
+		names := findNS(resolver.cache.get("dns.test.", "NS").Answer)
+		sort.Strings(names)
+		if strict {
+			assert.Equal(t, []string{"ns1.dns.test.", "old.dns.test."}, names)
+		} else {
+			// the nameserver the child no longer lists is not mixed in
+			assert.Equal(t, []string{"ns1.dns.test."}, names)
+		}
+
+		now = now.Add(2 * time.Minute)
+		ns := resolver.cache.get("dns.test.", "NS").Answer
+		if strict {
+			// the delegation of the parent expired
+			assert.Equal(t, 0, len(ns))
+		} else {
+			// the NS records of the child are cached for their own TTL
+			assert.Equal(t, 1, len(ns))
+			assert.True(t, ns[0].Header().Ttl > 3000)
+		}
+	}
+}
+
+func TestQueryStateRace(t *testing.T) {
+	// test. is served by 6 nameservers, which are all queried at once for each query
+	mn := newMockNet(t)
+	delegation := []string{}
+	for i := 1; i <= 6; i++ {
+		delegation = append(delegation, fmt.Sprintf("test. 3600 IN NS ns%d.test.", i), fmt.Sprintf("ns%d.test. 3600 IN A 127.0.0.%d", i, 10+i))
+	}
+	mn.addServer("127.0.0.10", ".", delegation...)
+	zone := append([]string{}, delegation...)
+	for i := 0; i < 10; i++ {
+		zone = append(zone, fmt.Sprintf("www%d.dns.test. 3600 IN CNAME host%d.dns.test.", i, i), fmt.Sprintf("host%d.dns.test. 3600 IN A 10.10.10.%d", i, i))
+	}
+	for i := 1; i <= 6; i++ {
+		mn.addServer(fmt.Sprintf("127.0.0.%d", 10+i), "test.", zone...)
+	}
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetMaxNameservers(6)
+
+	// run with -race, the resolutions and the queries within each share state
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr, err := resolver.Resolve(fmt.Sprintf("www%d.dns.test", i), "A")
+			assert.Nil(t, err)
+			assert.Equal(t, []string{fmt.Sprintf("10.10.10.%d", i)}, findA(rr.Answer))
+		}(i)
+	}
+	wg.Wait()
+
+	// a name queried too often within a resolution is still detected as a loop
+	qs := newQueryState(0)
+	for i := 0; i < 4; i++ {
+		assert.True(t, qs.count("www.dns.test.", "A"))
+	}
+	assert.False(t, qs.count("www.dns.test.", "A"))
+}
+
+// bufferLogger keeps the debug logging in a buffer
+type bufferLogger struct {
+	m     sync.Mutex
+	lines []string
+}
+
+func (l *bufferLogger) Printf(format string, args ...interface{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestSetLogger(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	logger := &bufferLogger{}
+	resolver.SetLogger(logger)
+
+	// nothing is logged without debug logging
+	_, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	logger.m.Lock()
+	assert.Equal(t, 0, len(logger.lines))
+	logger.m.Unlock()
+
+	resolver.Debug(true)
+	_, err = resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	logger.m.Lock()
+	assert.True(t, len(logger.lines) > 0)
+	assert.Contains(t, logger.lines[0], "www.dns.test.")
+	logger.m.Unlock()
+}
+
+func TestTruncatedRetriesTCP(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"big.dns.test. 3600 IN TXT \"a large record that does not fit\"",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "big.dns.test." || w.RemoteAddr().Network() != "udp" {
+			return false
+		}
+		// over UDP only the header fits
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Authoritative = true
+		resp.Truncated = true
+		w.WriteMsg(resp)
+		return true
+	})
+
+	msg, err := resolver.Resolve("big.dns.test", "TXT")
+	assert.Nil(t, err)
+	assert.False(t, msg.Truncated)
+	assert.Equal(t, 1, len(msg.Answer))
+	assert.Equal(t, 2, server.received("big.dns.test.", "TXT"))
+}
+
+func TestAnswerInExtra(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"odd.dns.test. 3600 IN A 10.10.10.10",
+		"other.dns.test. 3600 IN A 10.10.10.11",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "odd.dns.test." {
+			return false
+		}
+		// the answer only ends up in the additional section, next to an unrelated record
+		resp := server.answer(req)
+		resp.Extra = append(resp.Answer, server.find("other.dns.test.", dns.TypeA)...)
+		resp.Answer = nil
+		w.WriteMsg(resp)
+		return true
+	})
+
+	rr, err := resolver.Resolve("odd.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 1, server.received("odd.dns.test.", "A"))
+}
+
+func TestSetConcurrency(t *testing.T) {
+	mn := newMockNet(t)
+	delegation := []string{
+		"test. 3600 IN NS ns1.test.",
+		"test. 3600 IN NS ns2.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"ns2.test. 3600 IN A 127.0.0.12",
+	}
+	mn.addServer("127.0.0.10", ".", delegation...)
+	zone := append([]string{"host.test. 3600 IN A 10.10.10.10"}, delegation...)
+	failing := mn.addServer("127.0.0.11", "test.", zone...)
+	working := mn.addServer("127.0.0.12", "test.", zone...)
+
+	// track how many queries are being answered at the same time
+	var m sync.Mutex
+	active, maxActive := 0, 0
+	track := func(fail bool) func(w dns.ResponseWriter, req *dns.Msg) bool {
+		return func(w dns.ResponseWriter, req *dns.Msg) bool {
+			m.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			m.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			m.Lock()
+			active--
+			m.Unlock()
+			if !fail {
+				return false
+			}
+			resp := &dns.Msg{}
+			resp.SetRcode(req, dns.RcodeServerFailure)
+			w.WriteMsg(resp)
+			return true
+		}
+	}
+	failing.setHandler(track(true))
+	working.setHandler(track(false))
+
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetShuffleNameservers(false)
+	resolver.SetConcurrency(false)
+	rr, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	// the working server is only asked after the failing one answered
+	assert.Equal(t, 1, failing.received("host.test.", "A"))
+	assert.Equal(t, 1, working.received("host.test.", "A"))
+	m.Lock()
+	assert.Equal(t, 1, maxActive)
+	m.Unlock()
+}
+
+func TestNewWithRoot(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"host.test. 3600 IN A 10.10.10.10",
+	)
+
+	resolver, err := NewWithRoot(strings.NewReader(`
+; an internal root
+.                    3600  NS  ns.root.internal.
+ns.root.internal.    3600  A   127.0.0.10
+`))
+	assert.Nil(t, err)
+	resolver.port = mn.port
+	rr, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+
+	// a root nameserver needs an address
+	_, err = NewWithRoot(strings.NewReader(". 3600 NS ns.root.internal.\n"))
+	assert.Equal(t, ErrNoRootHints, err)
+	_, err = NewWithRoot(strings.NewReader("ns.root.internal. 3600 A 127.0.0.10\n"))
+	assert.Equal(t, ErrNoRootHints, err)
+	// an unparsable zone is an error of its own
+	_, err = NewWithRoot(strings.NewReader("ns.root.internal. 3600 A not-an-address\n"))
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrNoRootHints, err)
+}
+
+func TestAddRootHint(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"host.test. 3600 IN A 10.10.10.10",
+	)
+
+	// the only root server of the hints does not answer
+	resolver, err := NewWithRoot(strings.NewReader(". 3600 NS dead.root.internal.\ndead.root.internal. 3600 A 127.0.0.9\n"))
+	assert.Nil(t, err)
+	resolver.port = mn.port
+	resolver.SetTimeout(time.Second)
+
+	assert.Nil(t, resolver.AddRootHint("Live.Root.Internal", net.ParseIP("127.0.0.10")))
+	assert.Nil(t, resolver.AddRootHint("live.root.internal.", net.ParseIP("::1")))
+	assert.ElementsMatch(t, []string{"dead.root.internal.", "live.root.internal."}, findNS(resolver.cache.get(".", "NS").Answer))
+	assert.Equal(t, []string{"127.0.0.10"}, findA(resolver.cache.get("live.root.internal.", "A").Answer))
+	assert.Equal(t, []string{"::1"}, findAAAA(resolver.cache.get("live.root.internal.", "AAAA").Answer))
+
+	rr, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+
+	assert.NotNil(t, resolver.AddRootHint("live.root.internal.", nil))
+}
+
+func TestFindMX(t *testing.T) {
+	rrs := []dns.RR{
+		&dns.MX{Hdr: dns.RR_Header{Name: "dns.test.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeMX}, Preference: 10, Mx: "mx1.dns.test."},
+		&dns.MX{Hdr: dns.RR_Header{Name: "dns.test.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeMX}, Preference: 10, Mx: "mx2.dns.test."},
+		&dns.A{Hdr: dns.RR_Header{Name: "mx1.dns.test.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")},
+	}
+	assert.Equal(t, []string{"mx1.dns.test.", "mx2.dns.test."}, findMX(rrs))
+}
+
+func TestSetSourcePortRange(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"host.dns.test. 3600 IN A 10.10.10.10",
+	)
+	// the mock layer records the source port of every query
+	var m sync.Mutex
+	ports := []int{}
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if addr, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Lock()
+			ports = append(ports, addr.Port)
+			m.Unlock()
+		}
+		return false
+	})
+	query := func(prefix string, n int) []int {
+		m.Lock()
+		ports = nil
+		m.Unlock()
+		for i := 0; i < n; i++ {
+			// a name that is not cached, so every query reaches the server
+			resolver.Resolve(fmt.Sprintf("%s%d.dns.test", prefix, i), "A")
+		}
+		m.Lock()
+		defer m.Unlock()
+		return append([]int{}, ports...)
+	}
+	distinct := func(ports []int) int {
+		seen := make(map[int]bool)
+		for _, port := range ports {
+			seen[port] = true
+		}
+		return len(seen)
+	}
+
+	// by default the operating system picks a random port
+	used := query("default", 10)
+	assert.True(t, len(used) >= 10)
+	assert.True(t, distinct(used) > 1)
+
+	resolver.SetSourcePortRange(41000, 41999)
+	used = query("ranged", 10)
+	assert.True(t, len(used) >= 10)
+	assert.True(t, distinct(used) > 1)
+	for _, port := range used {
+		assert.True(t, port >= 41000 && port <= 41999, "port %d is outside the range", port)
+	}
+}
+
+func TestSetRandSource(t *testing.T) {
+	nameservers := []string{"ns1.dns.test.", "ns2.dns.test.", "ns3.dns.test.", "ns4.dns.test.", "ns5.dns.test.", "ns6.dns.test."}
+	shuffled := func(resolver *Resolver) (orders []string) {
+		for i := 0; i < 5; i++ {
+			ns := append([]string{}, nameservers...)
+			resolver.shuffleNameservers(ns)
+			orders = append(orders, strings.Join(ns, ","))
+		}
+		return
+	}
+
+	// resolvers with the same seed shuffle the same way
+	first, second := New(), New()
+	first.SetRandSource(rand.NewSource(42))
+	second.SetRandSource(rand.NewSource(42))
+	orders := shuffled(first)
+	assert.Equal(t, orders, shuffled(second))
+
+	// the order differs between shuffles
+	seen := make(map[string]bool)
+	for _, order := range orders {
+		seen[order] = true
+	}
+	assert.True(t, len(seen) > 1)
+
+	second.SetRandSource(nil)
+	second.SetShuffleNameservers(false)
+	assert.Equal(t, strings.Join(nameservers, ","), shuffled(second)[0])
+}
+
+func TestSetTCPRetry(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"host.dns.test. 3600 IN A 10.10.10.10",
+		"other.dns.test. 3600 IN A 10.10.10.11",
+	)
+	// UDP is tampered with on the way to the server, TCP is not
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name == "test." || w.RemoteAddr().Network() != "udp" {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+		return true
+	})
+
+	_, err := resolver.Resolve("host.dns.test", "A")
+	assert.NotNil(t, err)
+
+	resolver.SetTCPRetry(true)
+	rr, err := resolver.Resolve("other.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.11"}, findA(rr.Answer))
+	assert.Equal(t, 2, server.received("other.dns.test.", "A"))
+}
+
+func TestResolveContext(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+		"slow.dns.test. 3600 IN A 10.10.10.11",
+	)
+	// the server never answers for slow, the query stays in flight
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		return req.Question[0].Name == "slow.dns.test."
+	})
+
+	rr, err := resolver.ResolveContext(context.Background(), "www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = resolver.ResolveContext(ctx, "slow.dns.test", "A")
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < Timeout/2, "the resolution took %s", time.Since(start))
+	assert.Equal(t, 1, server.received("slow.dns.test.", "A"))
+}
+
+func TestConcurrentQueriesShared(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	// a slow answer keeps the first query in flight while the others arrive
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name == "www.dns.test." {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	})
+
+	var wg sync.WaitGroup
+	answers := make([]*dns.Msg, 10)
+	for i := range answers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr, err := resolver.Resolve("www.dns.test", "A")
+			assert.Nil(t, err)
+			answers[i] = rr
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, server.received("www.dns.test.", "A"))
+	for i, rr := range answers {
+		assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+		// every resolution got its own message
+		for _, other := range answers[:i] {
+			assert.False(t, rr == other)
+		}
+	}
+}
+
+func TestClearCache(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+		"mail.dns.test. 3600 IN A 10.10.10.11",
+	)
+	for _, name := range []string{"www.dns.test", "mail.dns.test", "none.dns.test"} {
+		_, _ = resolver.Resolve(name, "A")
+	}
+
+	// only the flushed name goes upstream again
+	resolver.FlushName("WWW.dns.test")
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	assert.Equal(t, 2, server.received("www.dns.test.", "A"))
+	_, _ = resolver.Resolve("mail.dns.test", "A")
+	assert.Equal(t, 1, server.received("mail.dns.test.", "A"))
+
+	// after clearing the cache the root hints still lead to the answer
+	resolver.ClearCache()
+	rr, err = resolver.Resolve("mail.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.11"}, findA(rr.Answer))
+	assert.Equal(t, 2, server.received("mail.dns.test.", "A"))
+	_, _ = resolver.Resolve("none.dns.test", "A")
+	assert.Equal(t, 2, server.received("none.dns.test.", "A"))
+}
+
+func TestQNameMinimization(t *testing.T) {
+	for _, minimize := range []bool{true, false} {
+		mn := newMockNet(t)
+		root := mn.addServer("127.0.0.10", ".",
+			"test. 3600 IN NS ns1.test.",
+			"ns1.test. 3600 IN A 127.0.0.11",
+		)
+		tld := mn.addServer("127.0.0.11", "test.",
+			"test. 3600 IN NS ns1.test.",
+			"test. 3600 IN SOA ns1.test. hostmaster.test. 1 3600 600 86400 60",
+			"ns1.test. 3600 IN A 127.0.0.11",
+			"dns.test. 3600 IN NS ns1.dns.test.",
+			"ns1.dns.test. 3600 IN A 127.0.0.12",
+		)
+		mn.addServer("127.0.0.12", "dns.test.",
+			"dns.test. 3600 IN NS ns1.dns.test.",
+			"dns.test. 3600 IN SOA ns1.dns.test. hostmaster.dns.test. 1 3600 600 86400 60",
+			"ns1.dns.test. 3600 IN A 127.0.0.12",
+			"www.sub.dns.test. 3600 IN A 10.10.10.10",
+		)
+		resolver := mn.resolver("127.0.0.10")
+		resolver.SetQNameMinimization(minimize)
+
+		rr, err := resolver.Resolve("www.sub.dns.test", "A")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+		if minimize {
+			// the nameservers above the zone only learn the next label
+			assert.Equal(t, 0, root.received("www.sub.dns.test.", "A"))
+			assert.Equal(t, 0, tld.received("www.sub.dns.test.", "A"))
+			assert.Equal(t, 1, root.received("test.", "NS"))
+			assert.Equal(t, 1, tld.received("dns.test.", "NS"))
+		} else {
+			assert.Equal(t, 1, root.received("www.sub.dns.test.", "A"))
+			assert.Equal(t, 1, tld.received("www.sub.dns.test.", "A"))
+			assert.Equal(t, 0, root.received("test.", "NS"))
+			assert.Equal(t, 0, tld.received("dns.test.", "NS"))
+		}
+	}
+}
+
+func TestSetPort(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"host.test. 3600 IN A 10.10.10.10",
+	)
+	port, err := strconv.Atoi(mn.port)
+	assert.Nil(t, err)
+
+	resolver, err := NewWithRoot(strings.NewReader("mock.root. 3600 A 127.0.0.10\n. 3600 NS mock.root."))
+	assert.Nil(t, err)
+	assert.Equal(t, "53", resolver.upstreamPort())
+	resolver.SetPort(uint16(port))
+	rr, err := resolver.Resolve("host.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+
+	resolver.SetPort(0)
+	assert.Equal(t, "53", resolver.upstreamPort())
+}
+
+func TestSetDialer(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"host.dns.test. 3600 IN A 10.10.10.10",
+		"big.dns.test. 3600 IN TXT \"a large record that does not fit\"",
+	)
+	// the mock layer records the source address of every query, and truncates big.dns.test. over UDP
+	var m sync.Mutex
+	sources := map[string]bool{}
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		m.Lock()
+		sources[w.RemoteAddr().Network()+" "+host] = true
+		m.Unlock()
+		if req.Question[0].Name != "big.dns.test." || w.RemoteAddr().Network() != "udp" {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Authoritative = true
+		resp.Truncated = true
+		w.WriteMsg(resp)
+		return true
+	})
+
+	resolver.SetDialer(&net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.5")}})
+	rr, err := resolver.Resolve("host.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	// the retry over TCP is sent from the same address
+	rr, err = resolver.Resolve("big.dns.test", "TXT")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rr.Answer))
+	m.Lock()
+	assert.Equal(t, map[string]bool{"udp 127.0.0.5": true, "tcp 127.0.0.5": true}, sources)
+	m.Unlock()
+
+	// the source port range still applies
+	resolver.SetSourcePortRange(42000, 42999)
+	client := resolver.client()
+	assert.Equal(t, "127.0.0.5", client.Dialer.LocalAddr.(*net.UDPAddr).IP.String())
+	assert.True(t, client.Dialer.LocalAddr.(*net.UDPAddr).Port >= 42000)
+	assert.Equal(t, resolver.queryTimeout(), client.Dialer.Timeout)
+
+	resolver.SetSourcePortRange(0, 0)
+	resolver.SetDialer(nil)
+	assert.Nil(t, resolver.client().Dialer)
+}
+
+func TestClientShared(t *testing.T) {
+	resolver := New()
+	assert.True(t, resolver.client() == resolver.client())
+	assert.True(t, resolver.tcpClient() == resolver.tcpClient())
+
+	// changing the settings replaces the clients
+	udp := resolver.client()
+	resolver.SetTimeout(time.Second)
+	assert.False(t, udp == resolver.client())
+	assert.Equal(t, time.Second, resolver.client().Timeout)
+	assert.Equal(t, time.Second, resolver.tcpClient().Timeout)
+
+	// every query gets its own source port
+	resolver.SetSourcePortRange(42000, 42999)
+	assert.False(t, resolver.client() == resolver.client())
+}
+
+func BenchmarkQuerySingle(b *testing.B) {
+	mn := newMockNet(b)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"host.test. 3600 IN A 10.10.10.10",
+	)
+	resolver := mn.resolver("127.0.0.10")
+	qs := resolver.newResolveState(ResolveOptions{})
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := resolver.querySingle(ctx, "127.0.0.11", "host.test.", "A", qs, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSetTLS(t *testing.T) {
+	mn := newMockNet(t)
+	server := mn.addServer("127.0.0.21", "test.",
+		"host.test. 3600 IN A 10.10.10.10",
+	)
+	port, pool := mn.addTLSServer(server, "dot.test")
+	tlsPort, err := strconv.Atoi(port)
+	assert.Nil(t, err)
+	// plain queries are refused, so only the queries over TLS are answered
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		resp := &dns.Msg{}
+		if addr, ok := w.LocalAddr().(*net.TCPAddr); ok && addr.Port == tlsPort {
+			if req.Question[0].Qclass != dns.ClassCHAOS {
+				return false
+			}
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}, Txt: []string{"dot.test"}})
+			w.WriteMsg(resp)
+			return true
+		}
+		resp.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(resp)
+		return true
+	})
+
+	resolver := New()
+	assert.Equal(t, "53", resolver.upstreamPort())
+	resolver.SetTLS(&tls.Config{RootCAs: pool})
+	assert.Equal(t, "853", resolver.upstreamPort())
+	resolver.SetPort(uint16(tlsPort))
+
+	// the certificate is verified against the address of the forwarder
+	result, err := resolver.ResolveFull(context.Background(), "host.test", "A", WithForwarders("127.0.0.21"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(result.Msg.Answer))
+
+	// or the name set in the config
+	resolver.SetTLS(&tls.Config{RootCAs: pool, ServerName: "dot.test"})
+	resolver.FlushName("host.test")
+	_, err = resolver.ResolveFull(context.Background(), "host.test", "A", WithForwarders("127.0.0.21"))
+	assert.Nil(t, err)
+
+	// a certificate for another name is rejected
+	resolver.SetTLS(&tls.Config{RootCAs: pool, ServerName: "other.test"})
+	_, err = resolver.ResolveFull(context.Background(), "other.test", "A", WithForwarders("127.0.0.21"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, server.received("host.test.", "A"))
+	assert.Equal(t, 0, server.received("other.test.", "A"))
+
+	// CHAOS queries go to the port of DNS over TLS, so they are sent over TLS too
+	resolver.SetTLS(&tls.Config{RootCAs: pool})
+	hostname, err := resolver.ServerHostname("127.0.0.21")
+	assert.Nil(t, err)
+	assert.Equal(t, "dot.test", hostname)
+}
+
+func TestSetForwarders(t *testing.T) {
+	mn := newMockNet(t)
+	upstream := mn.addServer("127.0.0.21", "internal.",
+		"host.internal. 3600 IN A 10.10.10.10",
+	)
+	var m sync.Mutex
+	recursive := 0
+	upstream.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		m.Lock()
+		defer m.Unlock()
+		if req.RecursionDesired {
+			recursive++
+		}
+		return false
+	})
+	// the root is not running, the queries only reach the upstream
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetForwarders([]string{"127.0.0.21"})
+
+	rr, err := resolver.Resolve("host.internal", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	// the answer is cached
+	_, err = resolver.Resolve("host.internal", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, upstream.received("host.internal.", "A"))
+	m.Lock()
+	assert.Equal(t, 1, recursive)
+	m.Unlock()
+
+	// a failing upstream is skipped
+	resolver.SetForwarders([]string{"127.0.0.22", "127.0.0.21"})
+	resolver.SetTimeout(500 * time.Millisecond)
+	resolver.SetStaggerDelay(0)
+	_, err = resolver.Resolve("other.internal", "A")
+	assert.True(t, errors.Is(err, ErrNXDomain))
+	assert.Equal(t, 1, upstream.received("other.internal.", "A"))
+
+	assert.Equal(t, []string{"127.0.0.21"}, NewForwarding("127.0.0.21").forwarders)
+}
+
+func TestSetForwardersConcurrent(t *testing.T) {
+	mn := newMockNet(t)
+	records := []string{}
+	for i := 0; i < 8; i++ {
+		records = append(records, fmt.Sprintf("host%d.internal. 3600 IN A 10.10.10.10", i), fmt.Sprintf("opts%d.internal. 3600 IN A 10.10.10.10", i))
+	}
+	for _, ip := range []string{"127.0.0.21", "127.0.0.22"} {
+		mn.addServer(ip, "internal.", records...)
+	}
+	forwarders := []string{"127.0.0.21", "127.0.0.22"}
+	resolver := mn.resolver("127.0.0.10")
+	resolver.SetForwarders(forwarders)
+	router := []string{"127.0.0.22", "127.0.0.21"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// names that are not cached or in flight, so every resolution shuffles the forwarders
+			_, err := resolver.Resolve(fmt.Sprintf("host%d.internal", i), "A")
+			assert.Nil(t, err)
+			_, err = resolver.ResolveFull(context.Background(), fmt.Sprintf("opts%d.internal", i), "A", WithForwarders(router...))
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+	// the slices of the caller are not shuffled
+	assert.Equal(t, []string{"127.0.0.21", "127.0.0.22"}, forwarders)
+	assert.Equal(t, []string{"127.0.0.22", "127.0.0.21"}, router)
+}
+
+func TestConcurrentQueriesOptions(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	// a slow answer keeps the first query in flight while the second resolution starts
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name == "www.dns.test." {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rr, err := resolver.Resolve("www.dns.test", "A")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	}()
+	time.Sleep(30 * time.Millisecond)
+	// a resolution that may not use the nameserver does not get the answer of one that can
+	_, err := resolver.ResolveFull(context.Background(), "www.dns.test", "A", WithBlockedNameservers(net.ParseIP("127.0.0.11")))
+	assert.NotNil(t, err)
+	wg.Wait()
+}
+
+func TestConcurrentQueriesDeadline(t *testing.T) {
+	resolver, server := newMockResolver(t,
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name == "www.dns.test." {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return false
+	})
+	// the NS records are cached, so both resolutions wait for the same slow query
+	_, err := resolver.Resolve("dns.test", "NS")
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := resolver.ResolveFull(context.Background(), "www.dns.test", "A", WithTimeout(100*time.Millisecond))
+		assert.NotNil(t, err)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	// the resolution with the longer timeout queries again once the shared query ran out of time
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	wg.Wait()
+}
@@ -0,0 +1,142 @@
+package tinyresolver
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// ExtendedError is returned when a nameserver failed a query, and explained why with an Extended DNS Error (RFC 8914)
+type ExtendedError struct {
+	Rcode     int
+	InfoCode  uint16
+	ExtraText string
+	Server    string
+}
+
+// Error returns the reason the query failed
+func (e *ExtendedError) Error() string {
+	reason := dns.ExtendedErrorCodeToString[e.InfoCode]
+	if reason == "" {
+		reason = fmt.Sprintf("extended error %d", e.InfoCode)
+	}
+	if e.ExtraText != "" {
+		reason += ": " + e.ExtraText
+	}
+	return fmt.Sprintf("%s from %s (%s)", dns.RcodeToString[e.Rcode], e.Server, reason)
+}
+
+// Is makes errors.Is match ErrServFail against the rcode of the error
+func (e *ExtendedError) Is(target error) bool {
+	return rcodeIs(e.Rcode, target)
+}
+
+// DNSError is returned when a name does not exist or a nameserver answered with a failure rcode
+type DNSError struct {
+	Name  string
+	Rcode int
+}
+
+// Error returns the rcode and the name it is about
+func (e *DNSError) Error() string {
+	return fmt.Sprintf("%s for %s", dns.RcodeToString[e.Rcode], e.Name)
+}
+
+// Is makes errors.Is match ErrNXDomain and ErrServFail against the rcode of the error. A failure rcode also matches
+// ErrInvalidResponse, as the response could not be used
+func (e *DNSError) Is(target error) bool {
+	if target == ErrInvalidResponse {
+		return e.Rcode != dns.RcodeSuccess && e.Rcode != dns.RcodeNameError
+	}
+	return rcodeIs(e.Rcode, target)
+}
+
+// rcodeIs returns true if the rcode is the one of the sentinel error
+func rcodeIs(rcode int, target error) bool {
+	switch target {
+	case ErrNXDomain:
+		return rcode == dns.RcodeNameError
+	case ErrServFail:
+		return rcode == dns.RcodeServerFailure
+	}
+	return false
+}
+
+// extendedError returns the extended error of a failed response, or nil if the response did not fail or has no extended error
+func extendedError(msg *dns.Msg) *ExtendedError {
+	if msg == nil || msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError {
+		return nil
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			return &ExtendedError{
+				Rcode:     msg.Rcode,
+				InfoCode:  ede.InfoCode,
+				ExtraText: ede.ExtraText,
+			}
+		}
+	}
+	return nil
+}
+
+// IsNXDomain returns true if the message states the queried name does not exist
+func IsNXDomain(msg *dns.Msg) bool {
+	return msg != nil && msg.Rcode == dns.RcodeNameError
+}
+
+// IsNoData returns true if the message states the queried name exists, but has no records of the queried type
+func IsNoData(msg *dns.Msg) bool {
+	if msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 {
+		return false
+	}
+	return hasSOA(msg.Ns)
+}
+
+// MinTTL returns the lowest TTL of the records in the message, which is how long the message as a whole can be
+// cached. A message without records returns 0
+func MinTTL(msg *dns.Msg) uint32 {
+	if msg == nil {
+		return 0
+	}
+	min, found := uint32(0), false
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			// the OPT record has no TTL, the field holds the extended flags
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if ttl := rr.Header().Ttl; !found || ttl < min {
+				min, found = ttl, true
+			}
+		}
+	}
+	return min
+}
+
+// hasSOA returns true if there is a SOA record in the records
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+// extraAnswer returns the records of the queried name and type from the additional section, for a response without
+// an answer that is no referral either. Misbehaving servers can return the answer there only
+func extraAnswer(msg *dns.Msg, qname string, qtype uint16) (res []dns.RR) {
+	if msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 || len(filterRR(msg.Ns, dns.TypeNS)) != 0 {
+		return nil
+	}
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == qtype && toLowerFQDN(rr.Header().Name) == toLowerFQDN(qname) {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
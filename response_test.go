@@ -0,0 +1,91 @@
+package tinyresolver
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoDataNXDomain(t *testing.T) {
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "dns.org.", Ttl: 3600, Class: dns.ClassINET, Rrtype: dns.TypeSOA}, Ns: "ns1.dns.org.", Mbox: "hostmaster.dns.org.", Minttl: 300}
+
+	// AAAA query on a host with only an A record
+	nodata := &dns.Msg{}
+	nodata.SetQuestion("v4only.dns.org.", dns.TypeAAAA)
+	nodata.Ns = append(nodata.Ns, soa)
+	assert.True(t, IsNoData(nodata))
+	assert.False(t, IsNXDomain(nodata))
+
+	// query on a host that does not exist
+	nxdomain := &dns.Msg{}
+	nxdomain.SetQuestion("nonexisting.dns.org.", dns.TypeA)
+	nxdomain.Rcode = dns.RcodeNameError
+	nxdomain.Ns = append(nxdomain.Ns, soa)
+	assert.False(t, IsNoData(nxdomain))
+	assert.True(t, IsNXDomain(nxdomain))
+
+	// a regular answer is neither
+	answer := &dns.Msg{}
+	answer.SetQuestion("v4only.dns.org.", dns.TypeA)
+	answer.Answer = append(answer.Answer, &dns.A{Hdr: dns.RR_Header{Name: "v4only.dns.org.", Ttl: 60, Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("10.10.10.10")})
+	assert.False(t, IsNoData(answer))
+	assert.False(t, IsNXDomain(answer))
+}
+
+func TestExtendedError(t *testing.T) {
+	resolver, server := newMockResolver(t, "blocked.dns.test. 3600 IN A 10.10.10.10")
+	server.setHandler(func(w dns.ResponseWriter, req *dns.Msg) bool {
+		if req.Question[0].Name != "blocked.dns.test." {
+			return false
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		resp.SetEdns0(EDNSBufferSize, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: "blocked by policy"})
+		w.WriteMsg(resp)
+		return true
+	})
+
+	_, err := resolver.Resolve("blocked.dns.test", "A")
+	var eerr *ExtendedError
+	assert.True(t, errors.As(err, &eerr))
+	assert.Equal(t, dns.RcodeServerFailure, eerr.Rcode)
+	assert.Equal(t, dns.ExtendedErrorCodeBlocked, eerr.InfoCode)
+	assert.Equal(t, "blocked by policy", eerr.ExtraText)
+	assert.Contains(t, err.Error(), "Blocked: blocked by policy")
+
+	// the query carried EDNS, so the server was able to send the extended error
+	server.m.Lock()
+	defer server.m.Unlock()
+	for _, q := range server.queries {
+		assert.NotNil(t, q.IsEdns0())
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN CNAME host.dns.test.",
+		"host.dns.test. 300 IN A 10.10.10.10",
+		"host.dns.test. 300 IN A 10.10.10.11",
+	)
+
+	msg, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(msg.Answer))
+	min := msg.Answer[0].Header().Ttl
+	for _, rr := range append(append(msg.Answer, msg.Ns...), msg.Extra...) {
+		if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < min {
+			min = rr.Header().Ttl
+		}
+	}
+	assert.Equal(t, min, MinTTL(msg))
+	assert.True(t, MinTTL(msg) <= 300)
+	assert.True(t, MinTTL(msg) > 0)
+
+	assert.Equal(t, uint32(0), MinTTL(&dns.Msg{}))
+	assert.Equal(t, uint32(0), MinTTL(nil))
+}
@@ -1,5 +1,11 @@
 package tinyresolver
 
+import (
+	"io"
+
+	"github.com/miekg/dns"
+)
+
 var root = `
 ;       This file holds the information on root name servers needed to
 ;       initialize cache of Internet domain name servers
@@ -92,3 +98,52 @@ L.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:9f::42
 .                        3600000      NS    M.ROOT-SERVERS.NET.
 M.ROOT-SERVERS.NET.      3600000      A     202.12.27.33
 M.ROOT-SERVERS.NET.      3600000      AAAA  2001:dc3::35`
+
+// rootAnchors are the DS records of the key signing keys of the root zone, KSK-2017 and KSK-2024
+var rootAnchors = `
+.	172800	IN	DS	20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+.	172800	IN	DS	38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16`
+
+// parseRootHints parses root hints in zone file format, they must have at least one nameserver of the root zone
+// together with its address
+func parseRootHints(hints io.Reader) ([]dns.RR, error) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(hints, ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	for _, ns := range filterRR(rrs, dns.TypeNS) {
+		if ns.Header().Name != "." {
+			continue
+		}
+		for _, rr := range rrs {
+			if t := rr.Header().Rrtype; (t == dns.TypeA || t == dns.TypeAAAA) && toLowerFQDN(rr.Header().Name) == toLowerFQDN(ns.(*dns.NS).Ns) {
+				return rrs, nil
+			}
+		}
+	}
+	return nil, ErrNoRootHints
+}
+
+// parseTrustAnchors parses DS and DNSKEY records in zone file format, other records are ignored
+func parseTrustAnchors(anchors io.Reader) ([]dns.RR, error) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(anchors, ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			normalizeNames(rr)
+			rrs = append(rrs, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(rrs) == 0 {
+		return nil, ErrNoTrustAnchor
+	}
+	return rrs, nil
+}
@@ -0,0 +1,76 @@
+package tinyresolver
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// SetAllowedClients limits the clients ServeDNS resolves for to the given networks, other clients are refused.
+// An empty list allows all clients
+func (r *Resolver) SetAllowedClients(networks []net.IPNet) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.allowedClients = append([]net.IPNet{}, networks...)
+}
+
+// allowed returns true if the client address is in one of the allowed networks
+func (r *Resolver) allowed(addr net.Addr) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if len(r.allowedClients) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	for _, network := range r.allowedClients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeDNS resolves a request and writes the answer, so the resolver can be used as the handler of a dns.Server
+func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	if !r.allowed(w.RemoteAddr()) {
+		resp.Rcode = dns.RcodeRefused
+		w.WriteMsg(resp)
+		return
+	}
+	if len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		w.WriteMsg(resp)
+		return
+	}
+
+	q := req.Question[0]
+	msg, err := r.Resolve(q.Name, dns.TypeToString[q.Qtype])
+	switch {
+	case err == ErrRefused:
+		resp.Rcode = dns.RcodeRefused
+	case msg == nil:
+		resp.Rcode = dns.RcodeServerFailure
+	default:
+		// a partial answer, such as an incomplete cname chain, is still returned
+		resp.Rcode = msg.Rcode
+		resp.Answer = msg.Answer
+		resp.Ns = msg.Ns
+		resp.Extra = withoutRR(msg.Extra, dns.TypeOPT)
+	}
+	w.WriteMsg(resp)
+}
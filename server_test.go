@@ -0,0 +1,54 @@
+package tinyresolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedClients(t *testing.T) {
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)
+	mn.addServer("127.0.0.11", "test.",
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"www.dns.test. 3600 IN A 10.10.10.10",
+	)
+	resolver := mn.resolver("127.0.0.10")
+	_, allowed, _ := net.ParseCIDR("127.0.0.32/30")
+	resolver.SetAllowedClients([]net.IPNet{*allowed})
+
+	srv := &dns.Server{Addr: net.JoinHostPort("127.0.0.20", mn.port), Net: "udp", Handler: resolver}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ListenAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	query := func(source string) *dns.Msg {
+		client := &dns.Client{Dialer: &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(source)}}}
+		qmsg := &dns.Msg{}
+		qmsg.SetQuestion("www.dns.test.", dns.TypeA)
+		rmsg, _, err := client.Exchange(qmsg, net.JoinHostPort("127.0.0.20", mn.port))
+		assert.Nil(t, err)
+		return rmsg
+	}
+
+	rmsg := query("127.0.0.33")
+	assert.Equal(t, dns.RcodeSuccess, rmsg.Rcode)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rmsg.Answer))
+
+	rmsg = query("127.0.0.40")
+	assert.Equal(t, dns.RcodeRefused, rmsg.Rcode)
+	assert.Equal(t, 0, len(rmsg.Answer))
+
+	// without an acl all clients are allowed
+	resolver.SetAllowedClients(nil)
+	rmsg = query("127.0.0.40")
+	assert.Equal(t, dns.RcodeSuccess, rmsg.Rcode)
+}
@@ -0,0 +1,65 @@
+package tinyresolver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Query is a name and type to resolve
+type Query struct {
+	Name string
+	Type string
+}
+
+// Result is the answer to a Query
+type Result struct {
+	Query Query
+	Msg   *dns.Msg
+	Err   error
+}
+
+// ResolveStream resolves the queries read from reqs, with up to concurrency at the same time, and sends the results in
+// the order they finish. The results channel is closed once reqs is closed and drained, or the context is done
+func (r *Resolver) ResolveStream(ctx context.Context, reqs <-chan Query, concurrency int) <-chan Result {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var q Query
+				var ok bool
+				select {
+				case q, ok = <-reqs:
+					if !ok {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+				res := Result{Query: q}
+				result, err := r.resolveSearch(ctx, q.Name, q.Type, ResolveOptions{})
+				if result != nil {
+					res.Msg = result.Msg
+				}
+				res.Err = err
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
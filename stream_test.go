@@ -0,0 +1,43 @@
+package tinyresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveStream(t *testing.T) {
+	records := []string{}
+	for i := 0; i < 10; i++ {
+		records = append(records, fmt.Sprintf("host%d.dns.test. 3600 IN A 10.10.10.%d", i, i))
+	}
+	resolver, _ := newMockResolver(t, records...)
+
+	reqs := make(chan Query)
+	go func() {
+		for i := 0; i < 10; i++ {
+			reqs <- Query{Name: fmt.Sprintf("host%d.dns.test", i), Type: "A"}
+		}
+		reqs <- Query{Name: "missing.dns.test", Type: "A"}
+		close(reqs)
+	}()
+
+	answers := make(map[string][]string)
+	for res := range resolver.ResolveStream(context.Background(), reqs, 3) {
+		if res.Query.Name == "missing.dns.test" {
+			assert.True(t, errors.Is(res.Err, ErrNXDomain))
+		} else {
+			assert.Nil(t, res.Err)
+		}
+		answers[res.Query.Name] = findA(res.Msg.Answer)
+	}
+	// the results channel was closed after all queries were answered
+	assert.Equal(t, 11, len(answers))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{fmt.Sprintf("10.10.10.%d", i)}, answers[fmt.Sprintf("host%d.dns.test", i)])
+	}
+	assert.Equal(t, 0, len(answers["missing.dns.test"]))
+}
@@ -0,0 +1,436 @@
+package tinyresolver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECError is returned when an answer fails DNSSEC validation, it matches ErrDNSSECBogus
+type DNSSECError struct {
+	Name   string
+	Reason string
+}
+
+// Error returns the name that failed validation, and why
+func (e *DNSSECError) Error() string {
+	return fmt.Sprintf("DNSSEC validation of %s failed: %s", e.Name, e.Reason)
+}
+
+// Is makes errors.Is match ErrDNSSECBogus
+func (e *DNSSECError) Is(target error) bool {
+	return target == ErrDNSSECBogus
+}
+
+// zoneKeys are the validated keys of a zone, or why they could not be validated
+type zoneKeys struct {
+	keys []*dns.DNSKEY
+	// secure is true if the chain of trust reaches the zone, false if the zone is not signed
+	secure bool
+	err    error
+}
+
+// validator validates the answer of a single resolution, and remembers the keys of the zones it validated
+type validator struct {
+	r       *Resolver
+	ctx     context.Context
+	qs      *queryState
+	depth   int
+	anchors []dns.RR
+	keys    map[string]zoneKeys
+	now     time.Time
+}
+
+// validate validates the records of the answer with DNSSEC, and the proof of a NODATA or NXDOMAIN answer. It sets the
+// AD flag if all are signed by a secure zone. A *DNSSECError is returned if a record or the proof fails validation
+func (r *Resolver) validate(ctx context.Context, qname, qtype string, msg *dns.Msg, depth int, qs *queryState) error {
+	v := &validator{
+		r:       r,
+		ctx:     ctx,
+		qs:      qs,
+		depth:   depth,
+		anchors: r.trustAnchors(),
+		keys:    make(map[string]zoneKeys),
+		now:     time.Now(),
+	}
+	msg.AuthenticatedData = false
+	secure := true
+	sets := rrsets(msg.Answer)
+	for _, set := range sets {
+		ok, err := v.validateSet(set, msg.Answer)
+		if err != nil {
+			if r.debugging() {
+				r.logf("DNSSEC BOGUS depth:%d - %s", depth, err)
+			}
+			return err
+		}
+		secure = secure && ok
+	}
+	negative := IsNXDomain(msg) || IsNoData(msg)
+	if negative {
+		// the answer can be a CNAME chain leading to the name that does not exist
+		name := cnameTarget(msg.Answer, qname)
+		ok, err := v.validateDenial(v.zoneOf(name), name, dns.StringToType[qtype], msg)
+		if err != nil {
+			if r.debugging() {
+				r.logf("DNSSEC BOGUS depth:%d - %s", depth, err)
+			}
+			return err
+		}
+		secure = secure && ok
+	}
+	msg.AuthenticatedData = secure && (len(sets) > 0 || negative)
+	return nil
+}
+
+// validateDenial validates the proof of a NODATA or NXDOMAIN answer for a name by the zone that answered. It returns
+// true if the zone is secure and proves the answer, false if the zone is not signed
+func (v *validator) validateDenial(zone, name string, rrtype uint16, msg *dns.Msg) (bool, error) {
+	for _, soa := range filterRR(msg.Ns, dns.TypeSOA) {
+		// the SOA record names the zone if it is below the closest zone we know of, the DS records are in the parent
+		owner := toLowerFQDN(soa.Header().Name)
+		if dns.IsSubDomain(zone, owner) && dns.IsSubDomain(owner, name) && (rrtype != dns.TypeDS || owner != name) {
+			zone = owner
+		}
+	}
+	keys := v.zoneKeys(zone)
+	if keys.err != nil || !keys.secure {
+		return false, keys.err
+	}
+	proofs, err := v.proofs(msg.Ns)
+	if err != nil {
+		return false, err
+	}
+	if !deniedBy(proofs, name, rrtype, IsNXDomain(msg)) {
+		return false, &DNSSECError{Name: name, Reason: fmt.Sprintf("signed zone %s gives no proof the %s records do not exist", zone, dns.TypeToString[rrtype])}
+	}
+	return true, nil
+}
+
+// proofs returns the NSEC and NSEC3 records of the authority section whose signatures verify
+func (v *validator) proofs(rrs []dns.RR) (res []dns.RR, err error) {
+	for _, set := range rrsets(rrs) {
+		if t := set[0].Header().Rrtype; t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		ok, err := v.validateSet(set, rrs)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, set...)
+		}
+	}
+	return res, nil
+}
+
+// validateSet validates a set of records with the signatures in rrs. It returns true if the set is signed by a
+// secure zone, false if the zone is not signed
+func (v *validator) validateSet(set []dns.RR, rrs []dns.RR) (bool, error) {
+	name := toLowerFQDN(set[0].Header().Name)
+	rrtype := set[0].Header().Rrtype
+	sigs := signaturesOf(rrs, name, rrtype)
+	if len(sigs) == 0 {
+		if rrtype == dns.TypeNS {
+			// the delegation of the parent zone is not signed, only the NS records published by the zone itself are
+			return false, nil
+		}
+		keys := v.zoneKeys(v.zoneOf(name))
+		if keys.err != nil {
+			return false, keys.err
+		}
+		if keys.secure {
+			return false, &DNSSECError{Name: name, Reason: fmt.Sprintf("%s records of a signed zone have no signature", dns.TypeToString[rrtype])}
+		}
+		return false, nil
+	}
+	var last error
+	for _, sig := range sigs {
+		signer := toLowerFQDN(sig.SignerName)
+		if !dns.IsSubDomain(signer, name) {
+			last = &DNSSECError{Name: name, Reason: fmt.Sprintf("signed by %s, which is not a parent zone", signer)}
+			continue
+		}
+		keys := v.zoneKeys(signer)
+		if keys.err != nil {
+			return false, keys.err
+		}
+		if !keys.secure {
+			return false, nil
+		}
+		if last = v.verify(sig, keys.keys, set); last == nil {
+			return true, nil
+		}
+	}
+	return false, last
+}
+
+// verify checks the signature of a set with the key it was signed with
+func (v *validator) verify(sig *dns.RRSIG, keys []*dns.DNSKEY, set []dns.RR) error {
+	name := toLowerFQDN(set[0].Header().Name)
+	if !sig.ValidityPeriod(v.now) {
+		return &DNSSECError{Name: name, Reason: fmt.Sprintf("signature of the %s records expired or is not yet valid", dns.TypeToString[sig.TypeCovered])}
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, set); err == nil {
+			return nil
+		}
+	}
+	return &DNSSECError{Name: name, Reason: fmt.Sprintf("no key of %s verifies the signature of the %s records", sig.SignerName, dns.TypeToString[sig.TypeCovered])}
+}
+
+// zoneKeys returns the keys of a zone, validated along the chain of trust from a trust anchor
+func (v *validator) zoneKeys(zone string) zoneKeys {
+	if keys, ok := v.keys[zone]; ok {
+		return keys
+	}
+	keys := v.findKeys(zone)
+	v.keys[zone] = keys
+	return keys
+}
+
+// findKeys validates the keys of a zone with the trust anchors of the zone, or with the DS records at its parent
+func (v *validator) findKeys(zone string) zoneKeys {
+	trusted := v.anchorsOf(zone)
+	if len(trusted) == 0 {
+		if !v.belowAnchor(zone) {
+			return zoneKeys{}
+		}
+		ds, secure, err := v.findDS(zone)
+		if err != nil || !secure || len(ds) == 0 {
+			// the parent is not signed, or proves the zone has no DS records so the zone is not signed
+			return zoneKeys{err: err}
+		}
+		trusted = ds
+	}
+
+	msg, err := v.r.queryWithCache(v.ctx, zone, "DNSKEY", v.depth+1, v.qs)
+	if err != nil {
+		return zoneKeys{err: &DNSSECError{Name: zone, Reason: fmt.Sprintf("no DNSKEY records: %s", err)}}
+	}
+	set := filterRR(msg.Answer, dns.TypeDNSKEY)
+	var keys, entry []*dns.DNSKEY
+	for _, rr := range set {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		if trustedKey(key, trusted) {
+			entry = append(entry, key)
+		}
+	}
+	if len(entry) == 0 {
+		return zoneKeys{err: &DNSSECError{Name: zone, Reason: "no DNSKEY matches a trusted DS or DNSKEY record"}}
+	}
+	// the keys are trusted once signed by the key the DS record or trust anchor points to
+	err = &DNSSECError{Name: zone, Reason: "DNSKEY records are not signed"}
+	for _, sig := range signaturesOf(msg.Answer, zone, dns.TypeDNSKEY) {
+		if err = v.verify(sig, entry, set); err == nil {
+			return zoneKeys{keys: keys, secure: true}
+		}
+	}
+	return zoneKeys{err: err}
+}
+
+// findDS returns the DS records of a zone at its parent, validated with the keys of the parent zone. secure is false
+// if the parent zone is not signed, or proves the zone has no DS records. A signed parent that denies the DS records
+// without proof fails validation, as the denial could be spoofed to turn off validation of the zone
+func (v *validator) findDS(zone string) (ds []dns.RR, secure bool, err error) {
+	msg := v.r.cache.get(zone, "DS")
+	if len(filterRR(msg.Answer, dns.TypeDS)) == 0 {
+		msg, err = v.queryParent(zone, "DS")
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	ds = filterRR(msg.Answer, dns.TypeDS)
+	if len(ds) == 0 {
+		pname, _ := parent(zone)
+		_, err = v.validateDenial(v.zoneOf(pname), zone, dns.TypeDS, msg)
+		return nil, false, err
+	}
+	for _, sig := range signaturesOf(msg.Answer, zone, dns.TypeDS) {
+		signer := toLowerFQDN(sig.SignerName)
+		if signer == zone || !dns.IsSubDomain(signer, zone) {
+			// the DS records are signed by a parent zone, never by the zone itself
+			continue
+		}
+		keys := v.zoneKeys(signer)
+		if keys.err != nil || !keys.secure {
+			return nil, false, keys.err
+		}
+		if err = v.verify(sig, keys.keys, ds); err == nil {
+			return ds, true, nil
+		}
+	}
+	if err == nil {
+		err = &DNSSECError{Name: zone, Reason: "DS records are not signed by the parent zone"}
+	}
+	return nil, false, err
+}
+
+// queryParent queries the nameservers of the parent zone, which hold the DS records of a zone, and caches the answer
+func (v *validator) queryParent(zone, qtype string) (*dns.Msg, error) {
+	pname, ok := parent(zone)
+	if !ok {
+		return nil, ErrMaxParent
+	}
+	pmsg, err := v.r.queryWithCache(v.ctx, pname, "NS", v.depth+1, v.qs)
+	if err != nil {
+		return nil, err
+	}
+	// a name that is not a zone has no NS records, the primary nameserver in the SOA record of its zone is used
+	nsrrs := append(append([]dns.RR{}, pmsg.Answer...), pmsg.Ns...)
+	pns := uniqueNames(findNS(nsrrs))
+	if len(pns) == 0 {
+		return nil, ErrNoNS
+	}
+	for _, ns := range pns {
+		msg, err := v.r.querySingle(v.ctx, ns, zone, qtype, v.qs, v.depth+1)
+		if err != nil {
+			continue
+		}
+		scrubBailiwick(msg, filterZone(nsrrs))
+		v.r.cache.addZoneMsg(&dns.Msg{Answer: msg.Answer}, filterZone(nsrrs))
+		return msg, nil
+	}
+	return nil, ErrNoNS
+}
+
+// anchorsOf returns the trust anchors of a zone
+func (v *validator) anchorsOf(zone string) (res []dns.RR) {
+	for _, rr := range v.anchors {
+		if rr.Header().Name == zone {
+			res = append(res, rr)
+		}
+	}
+	return
+}
+
+// belowAnchor returns true if a trust anchor is at or above the zone, so a chain of trust can reach it
+func (v *validator) belowAnchor(zone string) bool {
+	for _, rr := range v.anchors {
+		if dns.IsSubDomain(rr.Header().Name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneOf returns the closest zone of a name that has nameservers cached, which is the zone the name is in
+func (v *validator) zoneOf(name string) string {
+	for zone, ok := name, true; ok; zone, ok = parent(zone) {
+		if len(filterRR(v.r.cache.get(zone, "NS").Answer, dns.TypeNS)) > 0 {
+			return zone
+		}
+	}
+	return "."
+}
+
+// trustedKey returns true if the key matches a DS record or is a DNSKEY in the trusted records
+func trustedKey(key *dns.DNSKEY, trusted []dns.RR) bool {
+	for _, rr := range trusted {
+		switch t := rr.(type) {
+		case *dns.DS:
+			ds := key.ToDS(t.DigestType)
+			if ds != nil && ds.KeyTag == t.KeyTag && ds.Algorithm == t.Algorithm && strings.EqualFold(ds.Digest, t.Digest) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if key.Algorithm == t.Algorithm && key.Protocol == t.Protocol && key.PublicKey == t.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rrsets groups the records by name and type, leaving out the signatures
+func rrsets(rrs []dns.RR) (res [][]dns.RR) {
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		key := toLowerFQDN(rr.Header().Name) + "_" + dns.TypeToString[rr.Header().Rrtype]
+		id, ok := index[key]
+		if !ok {
+			id = len(res)
+			index[key] = id
+			res = append(res, nil)
+		}
+		res[id] = append(res[id], rr)
+	}
+	return
+}
+
+// signaturesOf returns the signatures in rrs covering the records of a name and type
+func signaturesOf(rrs []dns.RR, name string, rrtype uint16) (res []*dns.RRSIG) {
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype && toLowerFQDN(sig.Hdr.Name) == name {
+			res = append(res, sig)
+		}
+	}
+	return
+}
+
+// deniedBy returns true if the NSEC or NSEC3 records prove the name has no records of the type, or does not exist at
+// all for a NXDOMAIN answer. Only the name itself is checked, not the wildcard that could have matched it
+func deniedBy(proofs []dns.RR, name string, rrtype uint16, nxdomain bool) bool {
+	for _, rr := range proofs {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			if !nxdomain && toLowerFQDN(t.Hdr.Name) == name && !hasType(t.TypeBitMap, rrtype) && !hasType(t.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			if nxdomain && nsecCovers(t, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if !nxdomain && t.Match(name) && !hasType(t.TypeBitMap, rrtype) && !hasType(t.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			// an opt-out NSEC3 record covers delegations without DS records
+			if (nxdomain || (rrtype == dns.TypeDS && t.Flags&1 == 1)) && t.Cover(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecCovers returns true if the name sorts between the owner and the next name of the NSEC record, the last record
+// of a zone points back to the apex
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := toLowerFQDN(nsec.Hdr.Name), toLowerFQDN(nsec.NextDomain)
+	if !canonicalLess(owner, next) {
+		return canonicalLess(owner, name) && dns.IsSubDomain(next, name)
+	}
+	return canonicalLess(owner, name) && canonicalLess(name, next)
+}
+
+// canonicalLess returns true if name a sorts before b in the canonical order of RFC 4034, by comparing the labels
+// from the right
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if x, y := la[len(la)-i], lb[len(lb)-i]; x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// hasType returns true if the type is set in the type bitmap of a NSEC or NSEC3 record
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package tinyresolver
+
+import (
+	"crypto"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newZoneKey generates a key signing key for a zone
+func newZoneKey(t *testing.T, zone string) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	assert.Nil(t, err)
+	return key, priv.(crypto.Signer)
+}
+
+// signRecords returns the records together with their signatures by the key
+func signRecords(t *testing.T, key *dns.DNSKEY, priv crypto.Signer, records ...string) []string {
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		assert.Nil(t, err)
+		rrs = append(rrs, rr)
+	}
+	res := append([]string{}, records...)
+	for _, set := range rrsets(rrs) {
+		sig := &dns.RRSIG{
+			Hdr:         dns.RR_Header{Name: set[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: set[0].Header().Ttl},
+			TypeCovered: set[0].Header().Rrtype,
+			Algorithm:   key.Algorithm,
+			Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+			KeyTag:      key.KeyTag(),
+			SignerName:  key.Hdr.Name,
+		}
+		assert.Nil(t, sig.Sign(priv, set))
+		res = append(res, sig.String())
+	}
+	return res
+}
+
+func TestValidate(t *testing.T) {
+	rootKey, rootPriv := newZoneKey(t, ".")
+	testKey, testPriv := newZoneKey(t, "test.")
+
+	mn := newMockNet(t)
+	mn.addServer("127.0.0.10", ".", append(signRecords(t, rootKey, rootPriv,
+		rootKey.String(),
+		testKey.ToDS(dns.SHA256).String(),
+	),
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+	)...)
+	// the signature of bad.test. is made for another address than the one served
+	bad := signRecords(t, testKey, testPriv, "bad.test. 3600 IN A 10.10.10.12")[1]
+	mn.addServer("127.0.0.11", "test.", append(signRecords(t, testKey, testPriv,
+		testKey.String(),
+		"test. 3600 IN NS ns1.test.",
+		"ns1.test. 3600 IN A 127.0.0.11",
+		"www.test. 3600 IN A 10.10.10.10",
+		// the NSEC records prove insecure.test. has no DS records, missing.test. does not exist and www.test. has
+		// only A records
+		"insecure.test. 3600 IN NSEC ns1.test. NS RRSIG NSEC",
+		"www.test. 3600 IN NSEC test. A RRSIG NSEC",
+	),
+		"bad.test. 3600 IN A 10.10.10.11", bad,
+		"unsigned.test. 3600 IN A 10.10.10.13",
+		"insecure.test. 3600 IN NS ns1.insecure.test.",
+		"ns1.insecure.test. 3600 IN A 127.0.0.12",
+		"spoofed.test. 3600 IN NS ns1.spoofed.test.",
+		"ns1.spoofed.test. 3600 IN A 127.0.0.13",
+	)...)
+	mn.addServer("127.0.0.12", "insecure.test.",
+		"insecure.test. 3600 IN NS ns1.insecure.test.",
+		"ns1.insecure.test. 3600 IN A 127.0.0.12",
+		"www.insecure.test. 3600 IN A 10.10.10.14",
+	)
+	mn.addServer("127.0.0.13", "spoofed.test.",
+		"spoofed.test. 3600 IN NS ns1.spoofed.test.",
+		"ns1.spoofed.test. 3600 IN A 127.0.0.13",
+		"www.spoofed.test. 3600 IN A 10.10.10.15",
+	)
+	anchor := rootKey.ToDS(dns.SHA256).String()
+
+	resolver := mn.resolver("127.0.0.10")
+	assert.Nil(t, resolver.SetTrustAnchor(strings.NewReader(anchor)))
+	resolver.EnableDNSSEC()
+
+	rr, err := resolver.Resolve("www.test", "A")
+	assert.Nil(t, err)
+	assert.True(t, rr.AuthenticatedData)
+	assert.Equal(t, []string{"10.10.10.10"}, findA(rr.Answer))
+	// the signatures are only returned when asked for
+	assert.Equal(t, 0, len(filterRR(rr.Answer, dns.TypeRRSIG)))
+
+	for _, name := range []string{"bad.test", "unsigned.test"} {
+		rr, err = resolver.Resolve(name, "A")
+		assert.True(t, errors.Is(err, ErrDNSSECBogus), "%s: %v", name, err)
+		assert.Nil(t, rr)
+	}
+
+	// a delegation the signed parent proves has no DS record leads to a zone that is not signed
+	rr, err = resolver.Resolve("www.insecure.test", "A")
+	assert.Nil(t, err)
+	assert.False(t, rr.AuthenticatedData)
+	assert.Equal(t, []string{"10.10.10.14"}, findA(rr.Answer))
+
+	// the signed parent denies the DS record of spoofed.test. without proof
+	rr, err = resolver.Resolve("www.spoofed.test", "A")
+	assert.True(t, errors.Is(err, ErrDNSSECBogus), "%v", err)
+	assert.Nil(t, rr)
+
+	// negative answers are authenticated by their proof
+	rr, err = resolver.Resolve("missing.test", "A")
+	assert.True(t, IsNXDomain(rr), "%v", err)
+	assert.True(t, rr.AuthenticatedData)
+	rr, err = resolver.Resolve("www.test", "AAAA")
+	assert.Nil(t, err)
+	assert.True(t, rr.AuthenticatedData)
+	assert.Equal(t, 0, len(rr.Answer))
+	// and fail validation without one
+	rr, err = resolver.Resolve("ns1.test", "AAAA")
+	assert.True(t, errors.Is(err, ErrDNSSECBogus), "%v", err)
+	assert.Nil(t, rr)
+	// also when the negative answer comes from the cache
+	rr, err = resolver.Resolve("www.test", "AAAA")
+	assert.Nil(t, err)
+	assert.True(t, rr.AuthenticatedData)
+
+	// the chain of trust has to start at the trust anchor
+	other, _ := newZoneKey(t, ".")
+	resolver = mn.resolver("127.0.0.10")
+	assert.Nil(t, resolver.SetTrustAnchor(strings.NewReader(other.String())))
+	resolver.EnableDNSSEC()
+	_, err = resolver.Resolve("www.test", "A")
+	assert.True(t, errors.Is(err, ErrDNSSECBogus))
+
+	// without validation the answer is not authenticated
+	rr, err = mn.resolver("127.0.0.10").Resolve("www.test", "A")
+	assert.Nil(t, err)
+	assert.False(t, rr.AuthenticatedData)
+
+	// the root key signing keys are the default trust anchors
+	assert.Equal(t, 2, len(New().trustAnchors()))
+	assert.Equal(t, ErrNoTrustAnchor, resolver.SetTrustAnchor(strings.NewReader(". 3600 IN NS a.root-servers.net.")))
+}
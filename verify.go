@@ -0,0 +1,44 @@
+package tinyresolver
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Diff is the difference between the expected values of a record, and the values currently resolved
+type Diff struct {
+	// Added are the values resolved, but not expected
+	Added []string
+	// Removed are the values expected, but not resolved
+	Removed []string
+}
+
+// Changed returns true if the resolved values differ from the expected values
+func (d *Diff) Changed() bool {
+	return len(d.Added) != 0 || len(d.Removed) != 0
+}
+
+// Verify resolves a record by name and type, and compares the values in the answer with the expected values
+func (r *Resolver) Verify(qname, qtype string, expected []string) (*Diff, error) {
+	msg, err := r.Resolve(qname, qtype)
+	if err != nil {
+		return nil, err
+	}
+	live := []string{}
+	for _, rr := range filterRR(msg.Answer, dns.StringToType[qtype]) {
+		live = append(live, strings.ToLower(strings.Split(rr.String(), "\t")[4]))
+	}
+	want := []string{}
+	for _, value := range expected {
+		want = append(want, strings.ToLower(value))
+	}
+	diff := &Diff{
+		Added:   difference(live, want),
+		Removed: difference(want, live),
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff, nil
+}
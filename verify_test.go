@@ -0,0 +1,26 @@
+package tinyresolver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN CNAME dns.test.",
+		"dns.test. 3600 IN A 10.10.10.10",
+		"dns.test. 3600 IN A 10.10.10.12",
+		"dns.test. 3600 IN MX 10 mx1.dns.test.",
+	)
+
+	diff, err := resolver.Verify("www.dns.test", "A", []string{"10.10.10.10", "10.10.10.11"})
+	assert.Nil(t, err)
+	assert.True(t, diff.Changed())
+	assert.Equal(t, []string{"10.10.10.12"}, diff.Added)
+	assert.Equal(t, []string{"10.10.10.11"}, diff.Removed)
+
+	diff, err = resolver.Verify("dns.test", "MX", []string{"10 MX1.dns.test."})
+	assert.Nil(t, err)
+	assert.False(t, diff.Changed())
+}
@@ -0,0 +1,15 @@
+package tinyresolver
+
+// ResolveWire resolves a record by name and type, and returns the answer in wire format
+func (r *Resolver) ResolveWire(qname, qtype string) ([]byte, error) {
+	msg, err := r.Resolve(qname, qtype)
+	if msg == nil {
+		return nil, err
+	}
+	wire, perr := msg.Pack()
+	if perr != nil {
+		return nil, perr
+	}
+	// an incomplete cname chain still has an answer, so its error is returned with the bytes
+	return wire, err
+}
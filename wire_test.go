@@ -0,0 +1,30 @@
+package tinyresolver
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveWire(t *testing.T) {
+	resolver, _ := newMockResolver(t,
+		"www.dns.test. 3600 IN CNAME web.dns.test.",
+		"web.dns.test. 3600 IN A 10.10.10.10",
+	)
+
+	wire, err := resolver.ResolveWire("www.dns.test", "A")
+	assert.Nil(t, err)
+	msg := &dns.Msg{}
+	assert.Nil(t, msg.Unpack(wire))
+	assert.Equal(t, []string{"web.dns.test."}, findCNAME(msg.Answer))
+	assert.Equal(t, []string{"10.10.10.10"}, findA(msg.Answer))
+
+	// the bytes are the same message as Resolve returns
+	rr, err := resolver.Resolve("www.dns.test", "A")
+	assert.Nil(t, err)
+	assert.Equal(t, len(rr.Answer), len(msg.Answer))
+	for i := range rr.Answer {
+		assert.True(t, dns.IsDuplicate(rr.Answer[i], msg.Answer[i]))
+	}
+}